@@ -0,0 +1,210 @@
+package wgdynamic
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// An AddressConfigurator configures IP addresses on local network interfaces.
+// Most callers should use NewNetlinkAddressConfigurator to configure the
+// operating system's network interfaces, or NewMemoryAddressConfigurator in
+// tests.
+type AddressConfigurator interface {
+	// AddAddresses adds ips to the network interface iface with the
+	// specified valid and preferred lifetimes. Addresses which are already
+	// present have their lifetimes updated.
+	AddAddresses(iface string, ips []*net.IPNet, valid, preferred time.Duration) error
+
+	// RemoveAddresses removes ips from the network interface iface.
+	// Addresses which are not present are ignored.
+	RemoveAddresses(iface string, ips []*net.IPNet) error
+}
+
+var (
+	_ AddressConfigurator = &NetlinkAddressConfigurator{}
+	_ AddressConfigurator = &MemoryAddressConfigurator{}
+)
+
+// An InterfaceConfigurator adds the addresses of each lease maintained by
+// Client.Maintain to a local network interface, and removes them when the
+// lease is lost.
+//
+// The valid and preferred lifetimes of the addresses are both set to the time
+// remaining in the lease, so the operating system removes the addresses even
+// if the lease is never renewed or explicitly removed.
+type InterfaceConfigurator struct {
+	// Addresses is used to configure the network interface. It must not be
+	// nil.
+	Addresses AddressConfigurator
+
+	// Interface specifies the name of the network interface, typically the
+	// WireGuard interface used by the Client.
+	Interface string
+
+	// Log specifies an error logger for the InterfaceConfigurator. If nil,
+	// all error logs are discarded.
+	Log *log.Logger
+}
+
+// Attach configures cfg to invoke the InterfaceConfigurator as leases are
+// acquired, renewed, and lost. Any existing OnEvent callback set on cfg is
+// invoked after the InterfaceConfigurator. Attach must be called before cfg is
+// used.
+func (ic *InterfaceConfigurator) Attach(cfg *MaintainConfig) {
+	next := cfg.OnEvent
+	cfg.OnEvent = func(e LeaseEvent) {
+		var (
+			op  string
+			err error
+		)
+
+		switch e.Type {
+		case LeaseAcquired, LeaseRenewed:
+			op, err = "add", ic.Apply(e.Lease)
+		case LeaseLost:
+			op, err = "remove", ic.Remove(e.Lease)
+		}
+		if err != nil {
+			ic.logf("%s: failed to %s addresses for %s lease: %v", ic.Interface, op, e.Type, err)
+		}
+
+		if next != nil {
+			next(e)
+		}
+	}
+}
+
+// Apply adds the addresses of l to the network interface with lifetimes
+// derived from l. Apply is idempotent and can be used for both new and renewed
+// leases.
+func (ic *InterfaceConfigurator) Apply(l *Lease) error {
+	remaining := time.Until(l.Expires()).Truncate(time.Second)
+	if remaining <= 0 {
+		return fmt.Errorf("wgdynamic: lease expired at %s", l.Expires())
+	}
+
+	return ic.Addresses.AddAddresses(ic.Interface, l.IPs, remaining, remaining)
+}
+
+// Remove removes the addresses of l from the network interface.
+func (ic *InterfaceConfigurator) Remove(l *Lease) error {
+	return ic.Addresses.RemoveAddresses(ic.Interface, l.IPs)
+}
+
+// logf creates a formatted log entry if ic.Log is not nil.
+func (ic *InterfaceConfigurator) logf(format string, v ...interface{}) {
+	if ic.Log == nil {
+		return
+	}
+
+	ic.Log.Printf(format, v...)
+}
+
+// An InterfaceAddress is an IP address configured on a network interface by
+// a MemoryAddressConfigurator.
+type InterfaceAddress struct {
+	// IP specifies the IP address and its subnet mask.
+	IP *net.IPNet
+
+	// Valid and Preferred specify the lifetimes of the address as of the time
+	// it was last added.
+	Valid, Preferred time.Duration
+}
+
+// A MemoryAddressConfigurator is an in-memory AddressConfigurator which is
+// useful for tests.
+type MemoryAddressConfigurator struct {
+	mu    sync.Mutex
+	addrs map[string][]InterfaceAddress
+}
+
+// NewMemoryAddressConfigurator creates an empty MemoryAddressConfigurator.
+func NewMemoryAddressConfigurator() *MemoryAddressConfigurator {
+	return &MemoryAddressConfigurator{
+		addrs: make(map[string][]InterfaceAddress),
+	}
+}
+
+// Addresses returns the addresses configured on the network interface iface,
+// in the order they were added.
+func (ac *MemoryAddressConfigurator) Addresses(iface string) []InterfaceAddress {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	addrs := make([]InterfaceAddress, 0, len(ac.addrs[iface]))
+	for _, a := range ac.addrs[iface] {
+		a.IP = cloneIPNets([]*net.IPNet{a.IP})[0]
+		addrs = append(addrs, a)
+	}
+
+	return addrs
+}
+
+// AddAddresses implements AddressConfigurator.
+func (ac *MemoryAddressConfigurator) AddAddresses(iface string, ips []*net.IPNet, valid, preferred time.Duration) error {
+	if err := checkLifetimes(valid, preferred); err != nil {
+		return err
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	addrs := ac.addrs[iface]
+	for _, ip := range cloneIPNets(ips) {
+		a := InterfaceAddress{
+			IP:        ip,
+			Valid:     valid,
+			Preferred: preferred,
+		}
+
+		if i := findAddress(addrs, ip); i >= 0 {
+			addrs[i] = a
+			continue
+		}
+
+		addrs = append(addrs, a)
+	}
+
+	ac.addrs[iface] = addrs
+	return nil
+}
+
+// RemoveAddresses implements AddressConfigurator.
+func (ac *MemoryAddressConfigurator) RemoveAddresses(iface string, ips []*net.IPNet) error {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	addrs := ac.addrs[iface]
+	for _, ip := range ips {
+		if i := findAddress(addrs, ip); i >= 0 {
+			addrs = append(addrs[:i], addrs[i+1:]...)
+		}
+	}
+
+	ac.addrs[iface] = addrs
+	return nil
+}
+
+// findAddress returns the index of ip in addrs, or -1 if it is not present.
+func findAddress(addrs []InterfaceAddress, ip *net.IPNet) int {
+	for i, a := range addrs {
+		if a.IP.String() == ip.String() {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// checkLifetimes verifies that valid and preferred are valid address
+// lifetimes.
+func checkLifetimes(valid, preferred time.Duration) error {
+	if valid <= 0 || preferred < 0 || preferred > valid {
+		return fmt.Errorf("wgdynamic: invalid address lifetimes: valid %s, preferred %s", valid, preferred)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+//go:build linux
+
+package wgdynamic
+
+import (
+	"errors"
+	"math"
+	"net"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// A NetlinkAddressConfigurator is an AddressConfigurator which configures the
+// operating system's network interfaces using route netlink.
+type NetlinkAddressConfigurator struct {
+	c *netlink.Conn
+}
+
+// NewNetlinkAddressConfigurator creates a NetlinkAddressConfigurator. Call
+// Close to release its resources.
+func NewNetlinkAddressConfigurator() (*NetlinkAddressConfigurator, error) {
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NetlinkAddressConfigurator{c: c}, nil
+}
+
+// Close releases the NetlinkAddressConfigurator's resources.
+func (ac *NetlinkAddressConfigurator) Close() error { return ac.c.Close() }
+
+// AddAddresses implements AddressConfigurator.
+func (ac *NetlinkAddressConfigurator) AddAddresses(iface string, ips []*net.IPNet, valid, preferred time.Duration) error {
+	if err := checkLifetimes(valid, preferred); err != nil {
+		return err
+	}
+
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	// Replace any existing addresses so their lifetimes are updated.
+	flags := netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Replace
+	for _, ip := range ips {
+		b, err := addressMessage(ifi.Index, ip, valid, preferred)
+		if err != nil {
+			return err
+		}
+
+		if err := ac.execute(unix.RTM_NEWADDR, flags, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveAddresses implements AddressConfigurator.
+func (ac *NetlinkAddressConfigurator) RemoveAddresses(iface string, ips []*net.IPNet) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		b, err := addressMessage(ifi.Index, ip, 0, 0)
+		if err != nil {
+			return err
+		}
+
+		err = ac.execute(unix.RTM_DELADDR, netlink.Request|netlink.Acknowledge, b)
+		if err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// execute sends a route netlink address request and waits for its
+// acknowledgement.
+func (ac *NetlinkAddressConfigurator) execute(typ netlink.HeaderType, flags netlink.HeaderFlags, b []byte) error {
+	_, err := ac.c.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  typ,
+			Flags: flags,
+		},
+		Data: b,
+	})
+	return err
+}
+
+// addressMessage produces a route netlink address message for ip on the
+// interface with index. Lifetimes are only included if valid is not zero.
+func addressMessage(index int, ip *net.IPNet, valid, preferred time.Duration) ([]byte, error) {
+	family, addr := uint8(unix.AF_INET6), ip.IP.To16()
+	if ip4 := ip.IP.To4(); ip4 != nil {
+		family, addr = unix.AF_INET, ip4
+	}
+
+	ones, bits := ip.Mask.Size()
+	if addr == nil || bits != len(addr)*8 {
+		return nil, &net.ParseError{Type: "IP address", Text: ip.String()}
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(unix.IFA_LOCAL, addr)
+	ae.Bytes(unix.IFA_ADDRESS, addr)
+
+	if valid != 0 {
+		// struct ifa_cacheinfo: preferred and valid lifetimes in seconds,
+		// followed by creation and update timestamps set by the kernel.
+		ci := make([]byte, unix.SizeofIfaCacheinfo)
+		nlenc.PutUint32(ci[0:4], lifetime(preferred))
+		nlenc.PutUint32(ci[4:8], lifetime(valid))
+		ae.Bytes(unix.IFA_CACHEINFO, ci)
+	}
+
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	// struct ifaddrmsg, followed by attributes.
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = uint8(ones)
+	nlenc.PutUint32(b[4:8], uint32(index))
+
+	return append(b, attrs...), nil
+}
+
+// lifetime converts d to an address lifetime in seconds, which must be less
+// than the kernel's infinite lifetime value.
+func lifetime(d time.Duration) uint32 {
+	s := d / time.Second
+	if s >= math.MaxUint32 {
+		return math.MaxUint32 - 1
+	}
+
+	return uint32(s)
+}
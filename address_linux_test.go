@@ -0,0 +1,110 @@
+//go:build linux
+
+package wgdynamic
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+func Test_addressMessage(t *testing.T) {
+	tests := []struct {
+		name             string
+		ip               *net.IPNet
+		valid, preferred time.Duration
+		family, prefix   uint8
+		attrs            []netlink.Attribute
+		ok               bool
+	}{
+		{
+			name: "bad mask",
+			ip: &net.IPNet{
+				IP:   net.IPv4(192, 0, 2, 1),
+				Mask: net.CIDRMask(64, 128),
+			},
+		},
+		{
+			name:   "OK IPv4 no lifetimes",
+			ip:     mustParseIPNet("192.0.2.1/24"),
+			family: unix.AF_INET,
+			prefix: 24,
+			attrs: []netlink.Attribute{
+				{Length: 8, Type: unix.IFA_LOCAL, Data: []byte{192, 0, 2, 1}},
+				{Length: 8, Type: unix.IFA_ADDRESS, Data: []byte{192, 0, 2, 1}},
+			},
+			ok: true,
+		},
+		{
+			name:      "OK IPv6 lifetimes",
+			ip:        mustParseIPNet("2001:db8::1/64"),
+			valid:     1 * time.Hour,
+			preferred: 30 * time.Minute,
+			family:    unix.AF_INET6,
+			prefix:    64,
+			attrs: []netlink.Attribute{
+				{Length: 20, Type: unix.IFA_LOCAL, Data: net.ParseIP("2001:db8::1")},
+				{Length: 20, Type: unix.IFA_ADDRESS, Data: net.ParseIP("2001:db8::1")},
+				{
+					Length: 20,
+					Type:   unix.IFA_CACHEINFO,
+					// Native endian preferred and valid lifetimes.
+					Data: append(append(nativeUint32(1800), nativeUint32(3600)...), make([]byte, 8)...),
+				},
+			},
+			ok: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := addressMessage(2, tt.ip, tt.valid, tt.preferred)
+			if tt.ok && err != nil {
+				t.Fatalf("failed to create message: %v", err)
+			}
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected an error, but none occurred")
+				}
+
+				return
+			}
+
+			if diff := cmp.Diff([]byte{tt.family, tt.prefix, 0, 0}, b[:4]); diff != "" {
+				t.Fatalf("unexpected ifaddrmsg header (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(nativeUint32(2), b[4:8]); diff != "" {
+				t.Fatalf("unexpected interface index (-want +got):\n%s", diff)
+			}
+
+			attrs, err := netlink.UnmarshalAttributes(b[unix.SizeofIfAddrmsg:])
+			if err != nil {
+				t.Fatalf("failed to unmarshal attributes: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.attrs, attrs); diff != "" {
+				t.Fatalf("unexpected attributes (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func mustParseIPNet(s string) *net.IPNet {
+	ipn, err := parseIPNet(s)
+	if err != nil {
+		panicf("failed to parse CIDR: %v", err)
+	}
+
+	return ipn
+}
+
+func nativeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	nlenc.PutUint32(b, v)
+	return b
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+
+package wgdynamic
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+)
+
+// errAddressUnimplemented is returned by NetlinkAddressConfigurator on
+// platforms which do not support route netlink.
+var errAddressUnimplemented = fmt.Errorf("wgdynamic: address configuration not implemented on %s", runtime.GOOS)
+
+// A NetlinkAddressConfigurator is an AddressConfigurator which configures the
+// operating system's network interfaces using route netlink. It is only
+// implemented on Linux.
+type NetlinkAddressConfigurator struct{}
+
+// NewNetlinkAddressConfigurator always returns an error on this platform.
+func NewNetlinkAddressConfigurator() (*NetlinkAddressConfigurator, error) {
+	return nil, errAddressUnimplemented
+}
+
+// Close implements io.Closer.
+func (*NetlinkAddressConfigurator) Close() error { return errAddressUnimplemented }
+
+// AddAddresses implements AddressConfigurator.
+func (*NetlinkAddressConfigurator) AddAddresses(_ string, _ []*net.IPNet, _, _ time.Duration) error {
+	return errAddressUnimplemented
+}
+
+// RemoveAddresses implements AddressConfigurator.
+func (*NetlinkAddressConfigurator) RemoveAddresses(_ string, _ []*net.IPNet) error {
+	return errAddressUnimplemented
+}
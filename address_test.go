@@ -0,0 +1,134 @@
+package wgdynamic_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestMemoryAddressConfigurator(t *testing.T) {
+	var (
+		ipv4 = mustIPNet("192.0.2.1/24")
+		ipv6 = mustIPNet("2001:db8::1/64")
+	)
+
+	ac := wgdynamic.NewMemoryAddressConfigurator()
+	if err := ac.AddAddresses("wg0", []*net.IPNet{ipv4, ipv6}, time.Hour, time.Minute); err != nil {
+		t.Fatalf("failed to add addresses: %v", err)
+	}
+
+	// Adding an existing address updates its lifetimes in place.
+	if err := ac.AddAddresses("wg0", []*net.IPNet{ipv4}, 2*time.Hour, 2*time.Hour); err != nil {
+		t.Fatalf("failed to update addresses: %v", err)
+	}
+
+	want := []wgdynamic.InterfaceAddress{
+		{IP: ipv4, Valid: 2 * time.Hour, Preferred: 2 * time.Hour},
+		{IP: ipv6, Valid: time.Hour, Preferred: time.Minute},
+	}
+
+	if diff := cmp.Diff(want, ac.Addresses("wg0")); diff != "" {
+		t.Fatalf("unexpected addresses after add (-want +got):\n%s", diff)
+	}
+
+	// Removing addresses which are not present is not an error.
+	if err := ac.RemoveAddresses("wg0", []*net.IPNet{ipv4, mustIPNet("192.0.2.2/24")}); err != nil {
+		t.Fatalf("failed to remove addresses: %v", err)
+	}
+
+	if diff := cmp.Diff(want[1:], ac.Addresses("wg0")); diff != "" {
+		t.Fatalf("unexpected addresses after remove (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]wgdynamic.InterfaceAddress{}, ac.Addresses("wg1")); diff != "" {
+		t.Fatalf("unexpected addresses on other interface (-want +got):\n%s", diff)
+	}
+
+	if err := ac.AddAddresses("wg0", []*net.IPNet{ipv4}, time.Minute, time.Hour); err == nil {
+		t.Fatal("expected an error for preferred lifetime exceeding valid lifetime, but none occurred")
+	}
+}
+
+func TestInterfaceConfiguratorAttach(t *testing.T) {
+	var (
+		ipA = mustIPNet("192.0.2.1/24")
+		ipB = mustIPNet("192.0.2.2/24")
+	)
+
+	ac := wgdynamic.NewMemoryAddressConfigurator()
+
+	var events []wgdynamic.LeaseEventType
+	cfg := &wgdynamic.MaintainConfig{
+		OnEvent: func(e wgdynamic.LeaseEvent) {
+			events = append(events, e.Type)
+		},
+	}
+
+	ic := &wgdynamic.InterfaceConfigurator{
+		Addresses: ac,
+		Interface: "wg0",
+	}
+	ic.Attach(cfg)
+
+	lease := func(ip *net.IPNet) *wgdynamic.Lease {
+		return &wgdynamic.Lease{
+			IPs:        []*net.IPNet{ip},
+			LeaseStart: time.Now(),
+			LeaseTime:  time.Hour,
+		}
+	}
+
+	check := func(ips ...*net.IPNet) {
+		t.Helper()
+
+		got := ac.Addresses("wg0")
+		if len(got) != len(ips) {
+			t.Fatalf("expected %d addresses, but got: %+v", len(ips), got)
+		}
+
+		for i, a := range got {
+			if diff := cmp.Diff(ips[i], a.IP); diff != "" {
+				t.Fatalf("unexpected address (-want +got):\n%s", diff)
+			}
+
+			// Lifetimes are the time remaining in the lease.
+			if a.Valid > time.Hour || a.Valid < 59*time.Minute || a.Preferred != a.Valid {
+				t.Fatalf("unexpected lifetimes for %s: valid %s, preferred %s", a.IP, a.Valid, a.Preferred)
+			}
+		}
+	}
+
+	// Simulate a renewal which changes addresses, followed by a loss.
+	cfg.OnEvent(wgdynamic.LeaseEvent{Type: wgdynamic.LeaseAcquired, Lease: lease(ipA)})
+	check(ipA)
+
+	cfg.OnEvent(wgdynamic.LeaseEvent{Type: wgdynamic.LeaseRenewed, Lease: lease(ipA)})
+	check(ipA)
+
+	cfg.OnEvent(wgdynamic.LeaseEvent{Type: wgdynamic.LeaseLost, Lease: lease(ipA)})
+	check()
+
+	cfg.OnEvent(wgdynamic.LeaseEvent{Type: wgdynamic.LeaseAcquired, Lease: lease(ipB)})
+	check(ipB)
+
+	want := []wgdynamic.LeaseEventType{
+		wgdynamic.LeaseAcquired,
+		wgdynamic.LeaseRenewed,
+		wgdynamic.LeaseLost,
+		wgdynamic.LeaseAcquired,
+	}
+
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Fatalf("unexpected chained events (-want +got):\n%s", diff)
+	}
+
+	// Expired leases are not applied.
+	expired := lease(ipA)
+	expired.LeaseStart = time.Now().Add(-2 * time.Hour)
+	if err := ic.Apply(expired); err == nil {
+		t.Fatal("expected an error for expired lease, but none occurred")
+	}
+}
@@ -27,6 +27,20 @@ type Client struct {
 	// when using a net.Conn transport other than *net.TCPConn, and most callers
 	// should use NewClient to construct a Client instead.
 	Dial func(ctx context.Context) (net.Conn, error)
+
+	// Version specifies the protocol version used for requests. If zero,
+	// version 1 is used.
+	Version int
+
+	// Strict enables strict validation of server responses. Responses with
+	// unknown or duplicate keys, invalid values, or keys which are not valid
+	// in a server response are rejected with an error naming the offending
+	// line.
+	Strict bool
+
+	// Metrics specifies optional Metrics which record dials and the outcome
+	// and latency of each request. If nil, no metrics are recorded.
+	Metrics *Metrics
 }
 
 // NewClient creates a new Client bound to the specified WireGuard interface.
@@ -100,12 +114,20 @@ func (c *Client) RequestIP(ctx context.Context, req *RequestIP) (*RequestIP, err
 	// Use a separate variable for the output so we don't overwrite the
 	// caller's request.
 	var rip *RequestIP
-	err := c.execute(ctx, func(rw io.ReadWriter) error {
-		if err := sendRequestIP(rw, fromClient, req); err != nil {
+	err := c.execute(ctx, "request_ip", func(rw io.ReadWriter) error {
+		if err := sendRequestIP(rw, fromClient, c.version(), req); err != nil {
+			return err
+		}
+
+		m, err := NewDecoder(rw).DecodeResponse("request_ip")
+		if err != nil {
 			return err
 		}
+		if m.Error != nil {
+			return registeredError(m.Error)
+		}
 
-		rrip, err := parseRequestIP(newKVParser(rw))
+		rrip, err := parseRequestIP(m.Pairs, fromServer, c.Strict)
 		if err != nil {
 			return err
 		}
@@ -120,13 +142,77 @@ func (c *Client) RequestIP(ctx context.Context, req *RequestIP) (*RequestIP, err
 	return rip, nil
 }
 
+// Do sends an arbitrary command message m to a server and returns the server's
+// response message. Do is useful for commands which do not have a dedicated
+// method, such as server-side extensions. If m.Version is zero, the Client's
+// protocol version is used.
+//
+// If the server responds with a protocol error, it is returned as an *Error
+// and the response message is nil.
+//
+// The provided Context must be non-nil. If the context expires before the
+// request is complete, an error is returned.
+func (c *Client) Do(ctx context.Context, m *Message) (*Message, error) {
+	if m == nil || m.Command == "" {
+		return nil, errors.New("wgdynamic: messages sent by clients must specify a command")
+	}
+
+	// Copy the message so we don't overwrite the caller's version.
+	req := *m
+	if req.Version == 0 {
+		req.Version = c.version()
+	}
+
+	var res *Message
+	err := c.execute(ctx, req.Command, func(rw io.ReadWriter) error {
+		if err := NewEncoder(rw).Encode(&req); err != nil {
+			return err
+		}
+
+		rm, err := NewDecoder(rw).DecodeResponse(req.Command)
+		if err != nil {
+			return err
+		}
+		if rm.Error != nil {
+			return registeredError(rm.Error)
+		}
+
+		res = rm
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// version returns the protocol version used for requests.
+func (c *Client) version() int {
+	if c.Version == 0 {
+		return defaultVersion
+	}
+
+	return c.Version
+}
+
 // deadlineNow is a time in the past that indicates a connection should
 // immediately time out.
 var deadlineNow = time.Unix(1, 0)
 
-// execute executes fn with a network connection backing rw.
-func (c *Client) execute(ctx context.Context, fn func(rw io.ReadWriter) error) error {
+// execute executes fn with a network connection backing rw, recording the
+// outcome of command cmd in c.Metrics.
+func (c *Client) execute(ctx context.Context, cmd string, fn func(rw io.ReadWriter) error) error {
+	start := time.Now()
+	err := c.do(ctx, fn)
+	c.Metrics.observeClient(cmd, err, time.Since(start))
+	return err
+}
+
+// do executes fn with a network connection backing rw.
+func (c *Client) do(ctx context.Context, fn func(rw io.ReadWriter) error) error {
 	conn, err := c.Dial(ctx)
+	c.Metrics.observeDial(err)
 	if err != nil {
 		return err
 	}
@@ -145,6 +231,12 @@ func (c *Client) execute(ctx context.Context, fn func(rw io.ReadWriter) error) e
 
 	select {
 	case <-ctx.Done():
+		// Reset rather than gracefully close the connection so the server
+		// cancels any request it is still handling on our behalf.
+		if tc, ok := conn.(*net.TCPConn); ok {
+			_ = tc.SetLinger(0)
+		}
+
 		if ctx.Err() == context.Canceled {
 			if err := conn.SetDeadline(deadlineNow); err != nil {
 				return err
@@ -2,9 +2,11 @@ package wgdynamic_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -173,6 +175,240 @@ errno=0
 	}
 }
 
+func TestClientRequestIPStrict(t *testing.T) {
+	tests := []struct {
+		name, res, line string
+	}{
+		{
+			name: "unknown key",
+			res:  "ip=192.0.2.1/32\nfoo=bar\n\n",
+			line: `line "foo=bar": unknown key`,
+		},
+		{
+			name: "duplicate key",
+			res:  "leasetime=10\nleasetime=20\n\n",
+			line: `line "leasetime=20": duplicate key`,
+		},
+		{
+			name: "duplicate address",
+			res:  "ip=192.0.2.1/32\nip=192.0.2.1/24\n\n",
+			line: `line "ip=192.0.2.1/24": duplicate address`,
+		},
+		{
+			name: "negative",
+			res:  "leasetime=-1\n\n",
+			line: `line "leasetime=-1": negative value`,
+		},
+		{
+			name: "overflow",
+			res:  "leasetime=9223372036854775807\n\n",
+			line: `line "leasetime=9223372036854775807": value overflows lease duration`,
+		},
+		{
+			name: "network prefix",
+			res:  "ip=2001:db8::/64\n\n",
+			line: `line "ip=2001:db8::/64": address is a network prefix, not a host`,
+		},
+		{
+			name: "misplaced header",
+			res:  "ip=192.0.2.1/32\nrequest_ip=1\n\n",
+			line: `line "request_ip=1": unexpected command header`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, done := testClient(t, tt.res)
+			c.Strict = true
+
+			_, err := c.RequestIP(context.Background(), nil)
+			_ = done()
+
+			if err == nil || !strings.Contains(err.Error(), tt.line) {
+				t.Fatalf("expected error containing %q, but got: %v", tt.line, err)
+			}
+		})
+	}
+
+	// The same responses are accepted when strict mode is disabled.
+	for _, tt := range tests {
+		t.Run("lenient "+tt.name, func(t *testing.T) {
+			c, done := testClient(t, tt.res)
+
+			_, err := c.RequestIP(context.Background(), nil)
+			_ = done()
+
+			if err != nil {
+				t.Fatalf("failed to request IP: %v", err)
+			}
+		})
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		c, done := testClient(t, "request_ip=1\nip=192.0.2.1/32\nip=2001:db8::ffff/64\nleasestart=1\nleasetime=10\nerrno=0\n\n")
+		c.Strict = true
+
+		_, err := c.RequestIP(context.Background(), nil)
+		_ = done()
+
+		if err != nil {
+			t.Fatalf("failed to request IP: %v", err)
+		}
+	})
+}
+
+func TestClientRequestIPManyAddresses(t *testing.T) {
+	// Server limits on request size must not apply to responses.
+	var (
+		res  strings.Builder
+		want []*net.IPNet
+	)
+
+	for i := 1; i <= 100; i++ {
+		ip := mustIPNet(fmt.Sprintf("192.0.2.%d/32", i))
+		want = append(want, ip)
+		res.WriteString("ip=" + ip.String() + "\n")
+	}
+	res.WriteString("\n")
+
+	c, done := testClient(t, res.String())
+	out, err := c.RequestIP(context.Background(), nil)
+	_ = done()
+	if err != nil {
+		t.Fatalf("failed to request IPs: %v", err)
+	}
+
+	if diff := cmp.Diff(want, out.IPs); diff != "" {
+		t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+	}
+}
+
+func TestClientDo(t *testing.T) {
+	tests := []struct {
+		name, res, req string
+		in, out        *wgdynamic.Message
+		err            error
+	}{
+		{
+			name: "no command",
+			in:   &wgdynamic.Message{},
+		},
+		{
+			name: "protocol error",
+			in:   &wgdynamic.Message{Command: "foo"},
+			req:  "foo=1\n\n",
+			res:  "errno=2\nerrmsg=Unsupported protocol\n\n",
+			err:  wgdynamic.ErrUnsupportedProtocol,
+		},
+		{
+			name: "unexpected EOF",
+			in:   &wgdynamic.Message{Command: "foo"},
+			req:  "foo=1\n\n",
+			res:  "bar=baz\n",
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "OK",
+			in: &wgdynamic.Message{
+				Command: "foo",
+				Pairs:   []wgdynamic.Pair{{Key: "bar", Value: "baz"}},
+			},
+			req: "foo=1\nbar=baz\n\n",
+			res: "bar=qux\nerrno=0\n\n",
+			out: &wgdynamic.Message{
+				Pairs: []wgdynamic.Pair{{Key: "bar", Value: "qux"}},
+			},
+		},
+		{
+			name: "OK header",
+			in: &wgdynamic.Message{
+				Command: "foo",
+				Version: 2,
+			},
+			req: "foo=2\n\n",
+			res: "foo=2\nbar=qux\n\n",
+			out: &wgdynamic.Message{
+				Command: "foo",
+				Version: 2,
+				Pairs:   []wgdynamic.Pair{{Key: "bar", Value: "qux"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.req == "" {
+				// Invalid messages must be rejected before the network is
+				// accessed, so a zero-value Client will suffice.
+				var c wgdynamic.Client
+				if _, err := c.Do(context.Background(), tt.in); err == nil {
+					t.Fatal("expected an error, but none occurred")
+				}
+
+				return
+			}
+
+			c, done := testClient(t, tt.res)
+
+			out, err := c.Do(context.Background(), tt.in)
+			req := done()
+
+			if diff := cmp.Diff(tt.req, req); diff != "" {
+				t.Fatalf("unexpected request (-want +got):\n%s", diff)
+			}
+
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected error %v, but got: %v", tt.err, err)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to perform request: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.out, out); diff != "" {
+				t.Fatalf("unexpected Message (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClientDoServer(t *testing.T) {
+	mux := wgdynamic.NewServeMux()
+	mux.HandleFunc("echo", func(w io.Writer, r *wgdynamic.Request) error {
+		return wgdynamic.NewEncoder(w).Encode(&wgdynamic.Message{
+			Pairs: r.Pairs,
+		})
+	})
+
+	c, done := testServer(t, &wgdynamic.Server{Handler: mux})
+	defer done()
+
+	pairs := []wgdynamic.Pair{
+		{Key: "foo", Value: "bar"},
+		{Key: "baz", Value: "qux"},
+	}
+
+	res, err := c.Do(context.Background(), &wgdynamic.Message{
+		Command: "echo",
+		Pairs:   pairs,
+	})
+	if err != nil {
+		t.Fatalf("failed to perform echo: %v", err)
+	}
+
+	if diff := cmp.Diff(&wgdynamic.Message{Pairs: pairs}, res); diff != "" {
+		t.Fatalf("unexpected Message (-want +got):\n%s", diff)
+	}
+
+	// Commands without a handler produce a protocol error.
+	if _, err := c.Do(context.Background(), &wgdynamic.Message{Command: "nope"}); !errors.Is(err, wgdynamic.ErrInvalidRequest) {
+		t.Fatalf("expected invalid request error, but got: %v", err)
+	}
+}
+
 func TestClientRequestIPBadRequest(t *testing.T) {
 	// A zero-value Client is sufficient for this test, and will also panic
 	// if the network is accessed (meaning that the code is broken).
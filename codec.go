@@ -0,0 +1,270 @@
+package wgdynamic
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Message is a wg-dynamic protocol message: an optional command header,
+// such as "request_ip=1", followed by key/value pairs and an optional
+// protocol error, and terminated by a blank line.
+type Message struct {
+	// Command is the command of the message, such as "request_ip". If empty,
+	// the message has no command header, as is the case for responses sent by
+	// a Server.
+	Command string
+
+	// Version is the protocol version of Command. If zero when encoding,
+	// version 1 is used.
+	Version int
+
+	// Pairs are the key/value pairs of the message, in order, excluding the
+	// command header and any errno/errmsg pairs.
+	Pairs []Pair
+
+	// Error is the protocol error carried by the errno/errmsg pairs of the
+	// message, if any. A decoded Error is never one of the package's
+	// registered errors, so it may be modified; use errors.Is to compare it.
+	Error *Error
+}
+
+// Add appends a key/value pair to the message.
+func (m *Message) Add(key, value string) {
+	m.Pairs = append(m.Pairs, Pair{Key: key, Value: value})
+}
+
+// Get returns the value of the first pair with the specified key. It returns
+// false if no pair has the key.
+func (m *Message) Get(key string) (string, bool) {
+	for _, p := range m.Pairs {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Int parses the value of the first pair with the specified key as an integer.
+func (m *Message) Int(key string) (int, error) {
+	v, err := m.value(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(v)
+}
+
+// Time parses the value of the first pair with the specified key as a UNIX
+// timestamp in seconds, as used by leasestart.
+func (m *Message) Time(key string) (time.Time, error) {
+	v, err := m.value(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(n, 0), nil
+}
+
+// IPNet parses the value of the first pair with the specified key as an IP
+// address with a subnet mask, such as "192.0.2.1/32". The full IP address is
+// retained rather than only the network address.
+func (m *Message) IPNet(key string) (*net.IPNet, error) {
+	v, err := m.value(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseIPNet(v)
+}
+
+// IPNets parses the values of all pairs with the specified key as IP addresses
+// with subnet masks, in order. It returns nil if no pair has the key.
+func (m *Message) IPNets(key string) ([]*net.IPNet, error) {
+	var ips []*net.IPNet
+	for _, p := range m.Pairs {
+		if p.Key != key {
+			continue
+		}
+
+		ip, err := parseIPNet(p.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+// value returns the value of the first pair with the specified key, or an
+// error if none is present.
+func (m *Message) value(key string) (string, error) {
+	v, ok := m.Get(key)
+	if !ok {
+		return "", fmt.Errorf("wgdynamic: no %q key in message", key)
+	}
+
+	return v, nil
+}
+
+// An Encoder writes Messages to an output stream.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder creates an Encoder which writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes m to the output stream. Encode returns an error without
+// writing anything if m cannot be encoded, such as when a key or value contains
+// "=" or a newline, or when a pair uses the errno or errmsg keys which are
+// reserved for Message.Error.
+func (e *Encoder) Encode(m *Message) error {
+	var b bytes.Buffer
+	if m.Command != "" {
+		if err := checkPair(Pair{Key: m.Command}); err != nil {
+			return err
+		}
+
+		v := m.Version
+		if v == 0 {
+			v = defaultVersion
+		}
+		if v < 0 {
+			return fmt.Errorf("wgdynamic: invalid version %d for command %q", v, m.Command)
+		}
+
+		b.WriteString(fmt.Sprintf("%s=%d\n", m.Command, v))
+	}
+
+	for _, p := range m.Pairs {
+		if err := checkPair(p); err != nil {
+			return err
+		}
+
+		b.WriteString(fmt.Sprintf("%s=%s\n", p.Key, p.Value))
+	}
+
+	if m.Error != nil {
+		eb, err := m.Error.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		b.Write(eb)
+	}
+
+	// A final newline completes the message.
+	b.WriteString("\n")
+
+	_, err := b.WriteTo(e.w)
+	return err
+}
+
+// checkPair verifies that p can be encoded without corrupting a message.
+func checkPair(p Pair) error {
+	switch p.Key {
+	case "":
+		return fmt.Errorf("wgdynamic: empty key with value %q", p.Value)
+	case "errno", "errmsg":
+		return fmt.Errorf("wgdynamic: key %q is reserved for protocol errors", p.Key)
+	}
+
+	if strings.ContainsAny(p.Key, "=\r\n") || strings.ContainsAny(p.Value, "=\r\n") {
+		return fmt.Errorf("wgdynamic: invalid characters in key/value pair %q", p.Key)
+	}
+
+	return nil
+}
+
+// A Decoder reads Messages from an input stream.
+type Decoder struct {
+	p *kvParser
+}
+
+// NewDecoder creates a Decoder which reads from r. The Decoder may buffer
+// input beyond the end of a Message. The number of pairs in a Message is not
+// limited, but lines must not exceed bufio.MaxScanTokenSize bytes.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{p: newKVParser(r)}
+}
+
+// Decode reads a Message which begins with a command header, such as a
+// request sent by a Client. Decode returns io.EOF if no more input is
+// available, or io.ErrUnexpectedEOF if the input ends before the terminating
+// blank line of a Message.
+func (d *Decoder) Decode() (*Message, error) {
+	return d.decode("", true)
+}
+
+// DecodeResponse reads a response Message for the specified command, such as
+// a response sent by a Server. If the response begins with a command header
+// for command, as sent by some servers, it populates the Command and Version
+// fields. DecodeResponse returns errors in the same way as Decode.
+func (d *Decoder) DecodeResponse(command string) (*Message, error) {
+	return d.decode(command, false)
+}
+
+// decode reads a Message. If header is true, the first pair is always a
+// command header. Otherwise, the first pair is a command header only if its
+// key is command.
+func (d *Decoder) decode(command string, header bool) (*Message, error) {
+	p := d.p
+	p.reset()
+
+	var m Message
+	for first := true; p.Next(); first = false {
+		k, v := p.Key(), p.String()
+		if first && (header || k == command) {
+			version, err := strconv.Atoi(v)
+			if err != nil || version < 1 {
+				return nil, fmt.Errorf("%w: %q for command %q", errBadVersion, v, k)
+			}
+
+			m.Command, m.Version = k, version
+			continue
+		}
+
+		m.Pairs = append(m.Pairs, Pair{Key: k, Value: v})
+	}
+
+	// Errors reading the input take precedence over an incomplete Message,
+	// which takes precedence over any protocol error.
+	err := p.Err()
+	werr, isProtocol := err.(*Error)
+	if err != nil && !isProtocol {
+		return nil, err
+	}
+
+	if !p.done {
+		if p.pairs == 0 {
+			return nil, io.EOF
+		}
+
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if werr != nil {
+		// The parser may return one of the package's registered errors, so
+		// copy it to prevent callers from modifying the original. errors.Is
+		// still matches the copy.
+		e := *werr
+		m.Error = &e
+	}
+
+	return &m, nil
+}
@@ -0,0 +1,366 @@
+package wgdynamic_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestEncoderEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *wgdynamic.Message
+		b    string
+		ok   bool
+	}{
+		{
+			name: "bad command",
+			m:    &wgdynamic.Message{Command: "request=ip"},
+		},
+		{
+			name: "bad version",
+			m: &wgdynamic.Message{
+				Command: "request_ip",
+				Version: -1,
+			},
+		},
+		{
+			name: "empty key",
+			m: &wgdynamic.Message{
+				Pairs: []wgdynamic.Pair{{Value: "foo"}},
+			},
+		},
+		{
+			name: "reserved key",
+			m: &wgdynamic.Message{
+				Pairs: []wgdynamic.Pair{{Key: "errno", Value: "0"}},
+			},
+		},
+		{
+			name: "newline in value",
+			m: &wgdynamic.Message{
+				Pairs: []wgdynamic.Pair{{Key: "foo", Value: "bar\n\nip=192.0.2.1/32"}},
+			},
+		},
+		{
+			name: "bad error",
+			m: &wgdynamic.Message{
+				Error: &wgdynamic.Error{Message: "success?"},
+			},
+		},
+		{
+			name: "OK empty",
+			m:    &wgdynamic.Message{},
+			b:    "\n",
+			ok:   true,
+		},
+		{
+			name: "OK default version",
+			m:    &wgdynamic.Message{Command: "request_ip"},
+			b:    "request_ip=1\n\n",
+			ok:   true,
+		},
+		{
+			name: "OK pairs",
+			m: &wgdynamic.Message{
+				Command: "request_ip",
+				Version: 2,
+				Pairs: []wgdynamic.Pair{
+					{Key: "ip", Value: "192.0.2.1/32"},
+					{Key: "leasetime", Value: "3600"},
+				},
+			},
+			b:  "request_ip=2\nip=192.0.2.1/32\nleasetime=3600\n\n",
+			ok: true,
+		},
+		{
+			name: "OK error",
+			m: &wgdynamic.Message{
+				Error: wgdynamic.ErrIPUnavailable,
+			},
+			b:  "errno=3\nerrmsg=Chosen IP(s) unavailable\n\n",
+			ok: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := wgdynamic.NewEncoder(&b).Encode(tt.m)
+			if tt.ok && err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected an error, but none occurred")
+				}
+				if b.Len() != 0 {
+					t.Fatalf("expected no output on error, but got: %q", b.String())
+				}
+
+				return
+			}
+
+			if diff := cmp.Diff(tt.b, b.String()); diff != "" {
+				t.Fatalf("unexpected output (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name     string
+		b        string
+		response bool
+		m        *wgdynamic.Message
+		err      error
+	}{
+		{
+			name: "EOF",
+			err:  io.EOF,
+		},
+		{
+			name: "unexpected EOF",
+			b:    "request_ip=1\nip=192.0.2.1/32\n",
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name:     "unexpected EOF error",
+			b:        "errno=1\nerrmsg=Invalid request\n",
+			response: true,
+			err:      io.ErrUnexpectedEOF,
+		},
+		{
+			name: "request",
+			b:    "request_ip=1\nip=192.0.2.1/32\nleasetime=10\n\n",
+			m: &wgdynamic.Message{
+				Command: "request_ip",
+				Version: 1,
+				Pairs: []wgdynamic.Pair{
+					{Key: "ip", Value: "192.0.2.1/32"},
+					{Key: "leasetime", Value: "10"},
+				},
+			},
+		},
+		{
+			name:     "response",
+			b:        "ip=192.0.2.1/32\nleasetime=10\n\n",
+			response: true,
+			m: &wgdynamic.Message{
+				Pairs: []wgdynamic.Pair{
+					{Key: "ip", Value: "192.0.2.1/32"},
+					{Key: "leasetime", Value: "10"},
+				},
+			},
+		},
+		{
+			name:     "response header",
+			b:        "request_ip=1\nip=192.0.2.1/32\n\n",
+			response: true,
+			m: &wgdynamic.Message{
+				Command: "request_ip",
+				Version: 1,
+				Pairs: []wgdynamic.Pair{
+					{Key: "ip", Value: "192.0.2.1/32"},
+				},
+			},
+		},
+		{
+			name:     "response error",
+			b:        "errno=1\nerrmsg=Invalid request\n\n",
+			response: true,
+			m: &wgdynamic.Message{
+				Error: wgdynamic.ErrInvalidRequest,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := wgdynamic.NewDecoder(strings.NewReader(tt.b))
+
+			decode := d.Decode
+			if tt.response {
+				decode = func() (*wgdynamic.Message, error) {
+					return d.DecodeResponse("request_ip")
+				}
+			}
+
+			m, err := decode()
+			if diff := cmp.Diff(tt.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Fatalf("unexpected error (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.m, m); diff != "" {
+				t.Fatalf("unexpected Message (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    string
+	}{
+		{
+			name: "malformed",
+			b:    "request_ip=1\nfoo\n\n",
+		},
+		{
+			name: "bad version",
+			b:    "request_ip=foo\n\n",
+		},
+		{
+			name: "negative version",
+			b:    "request_ip=-1\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := wgdynamic.NewDecoder(strings.NewReader(tt.b)).Decode()
+			if err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+		})
+	}
+}
+
+func TestDecoderErrorCopy(t *testing.T) {
+	m, err := wgdynamic.NewDecoder(strings.NewReader("errno=1\nerrmsg=Invalid request\n\n")).Decode()
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+
+	if !errors.Is(m.Error, wgdynamic.ErrInvalidRequest) {
+		t.Fatalf("expected ErrInvalidRequest, but got: %v", m.Error)
+	}
+
+	// Modifying the decoded error must not affect the package's errors.
+	m.Error.Message = "modified"
+	if diff := cmp.Diff("Invalid request", wgdynamic.ErrInvalidRequest.Message); diff != "" {
+		t.Fatalf("unexpected ErrInvalidRequest message (-want +got):\n%s", diff)
+	}
+}
+
+func TestEncoderDecoderStream(t *testing.T) {
+	ms := []*wgdynamic.Message{
+		{
+			Command: "request_ip",
+			Version: 1,
+			Pairs: []wgdynamic.Pair{
+				{Key: "ip", Value: "192.0.2.1/32"},
+				{Key: "ip", Value: "2001:db8::1/128"},
+			},
+		},
+		{
+			Command: "request_ip",
+			Version: 1,
+			Error: &wgdynamic.Error{
+				Number:  1,
+				Message: "first line\nsecond=line",
+			},
+		},
+		{
+			Command: "request_ip",
+			Version: 2,
+		},
+	}
+
+	var b bytes.Buffer
+	e := wgdynamic.NewEncoder(&b)
+	for _, m := range ms {
+		if err := e.Encode(m); err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+	}
+
+	d := wgdynamic.NewDecoder(&b)
+	for i, want := range ms {
+		got, err := d.Decode()
+		if err != nil {
+			t.Fatalf("failed to decode message %d: %v", i, err)
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("unexpected message %d (-want +got):\n%s", i, diff)
+		}
+	}
+
+	if _, err := d.Decode(); err != io.EOF {
+		t.Fatalf("expected io.EOF after final message, but got: %v", err)
+	}
+}
+
+func TestMessageAccessors(t *testing.T) {
+	m := &wgdynamic.Message{}
+	m.Add("ip", "192.0.2.1/24")
+	m.Add("ip", "2001:db8::1/64")
+	m.Add("leasestart", "1000")
+	m.Add("leasetime", "3600")
+	m.Add("foo", "bar")
+
+	if v, ok := m.Get("foo"); !ok || v != "bar" {
+		t.Fatalf("unexpected foo value: %q, %v", v, ok)
+	}
+	if _, ok := m.Get("bar"); ok {
+		t.Fatal("unexpectedly found bar key")
+	}
+
+	n, err := m.Int("leasetime")
+	if err != nil {
+		t.Fatalf("failed to parse leasetime: %v", err)
+	}
+	if diff := cmp.Diff(3600, n); diff != "" {
+		t.Fatalf("unexpected leasetime (-want +got):\n%s", diff)
+	}
+
+	start, err := m.Time("leasestart")
+	if err != nil {
+		t.Fatalf("failed to parse leasestart: %v", err)
+	}
+	if diff := cmp.Diff(time.Unix(1000, 0), start); diff != "" {
+		t.Fatalf("unexpected leasestart (-want +got):\n%s", diff)
+	}
+
+	ip, err := m.IPNet("ip")
+	if err != nil {
+		t.Fatalf("failed to parse ip: %v", err)
+	}
+	if diff := cmp.Diff(mustIPNet("192.0.2.1/24"), ip); diff != "" {
+		t.Fatalf("unexpected ip (-want +got):\n%s", diff)
+	}
+
+	ips, err := m.IPNets("ip")
+	if err != nil {
+		t.Fatalf("failed to parse ips: %v", err)
+	}
+	want := []*net.IPNet{
+		mustIPNet("192.0.2.1/24"),
+		mustIPNet("2001:db8::1/64"),
+	}
+	if diff := cmp.Diff(want, ips); diff != "" {
+		t.Fatalf("unexpected ips (-want +got):\n%s", diff)
+	}
+
+	// Missing keys and malformed values are errors.
+	if _, err := m.Int("bar"); err == nil {
+		t.Fatal("expected an error for missing key, but none occurred")
+	}
+	if _, err := m.Int("foo"); err == nil {
+		t.Fatal("expected an error for non-integer value, but none occurred")
+	}
+	if _, err := m.IPNets("foo"); err == nil {
+		t.Fatal("expected an error for non-IP value, but none occurred")
+	}
+}
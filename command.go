@@ -1,10 +1,12 @@
 package wgdynamic
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -35,6 +37,15 @@ type RequestIP struct {
 	// For servers, it indicates that the IP address assignment expires after
 	// this duration of time has elapsed.
 	LeaseTime time.Duration
+
+	// Extensions specify additional key/value pairs which are not otherwise
+	// defined by the request_ip command, in the order they were received.
+	// Unknown keys are retained in Extensions when parsing, and Extensions
+	// are sent after all other parameters.
+	//
+	// Extension keys must not be empty or duplicate any key defined by the
+	// protocol, and neither keys nor values may contain "=" or newlines.
+	Extensions []Pair
 }
 
 // Indicates if a command originates from client or server since the two are
@@ -44,72 +55,203 @@ const (
 	fromClient = true
 )
 
-// TODO(mdlayher): request_ip protocol version is hardcoded at 1 and should
-// be parameterized in some way.
+// defaultVersion is the protocol version of a command when none is specified.
+// It is also the only supported version of the request_ip command.
+const defaultVersion = 1
+
+// sendRequestIP writes a request_ip command of the specified protocol version
+// with optional IPv4/6 addresses to w.
+func sendRequestIP(w io.Writer, isClient bool, version int, rip *RequestIP) error {
+	m := &Message{
+		Command: "request_ip",
+		Version: version,
+	}
 
-// sendRequestIP writes a request_ip command with optional IPv4/6 addresses
-// to w.
-func sendRequestIP(w io.Writer, isClient bool, rip *RequestIP) error {
 	if rip == nil {
 		// No additional parameters to send.
-		_, err := w.Write([]byte("request_ip=1\n\n"))
-		return err
+		return NewEncoder(w).Encode(m)
 	}
 
-	// Build the command and attach optional parameters.
-	var b bytes.Buffer
-	if isClient {
+	if !isClient {
 		// Only clients issue the command header.
-		b.WriteString("request_ip=1\n")
+		m.Command = ""
 	}
 
+	// Attach optional parameters.
 	for _, ip := range rip.IPs {
-		b.WriteString(fmt.Sprintf("ip=%s\n", ip.String()))
+		m.Add("ip", ip.String())
 	}
 
 	if !rip.LeaseStart.IsZero() {
-		b.WriteString(fmt.Sprintf("leasestart=%d\n", rip.LeaseStart.Unix()))
+		m.Add("leasestart", strconv.FormatInt(rip.LeaseStart.Unix(), 10))
 	}
 	if rip.LeaseTime > 0 {
-		b.WriteString(fmt.Sprintf("leasetime=%d\n", int(rip.LeaseTime.Seconds())))
+		m.Add("leasetime", strconv.Itoa(int(rip.LeaseTime.Seconds())))
 	}
 
-	// A final newline completes the request.
-	b.WriteString("\n")
+	for _, p := range rip.Extensions {
+		if err := checkExtension(p); err != nil {
+			return err
+		}
 
-	_, err := b.WriteTo(w)
-	return err
+		m.Pairs = append(m.Pairs, p)
+	}
+
+	return NewEncoder(w).Encode(m)
 }
 
-// parseRequestIP parses a RequestIP from a request_ip command response stream.
-func parseRequestIP(p *kvParser) (*RequestIP, error) {
+// parseRequestIP parses a RequestIP from the key/value pairs of a request_ip
+// command or response. isClient indicates whether the pairs originated with a
+// client or server. If strict is true, the pairs are validated as described
+// by validateRequestIP.
+func parseRequestIP(pairs []Pair, isClient, strict bool) (*RequestIP, error) {
+	if strict {
+		if err := validateRequestIP(pairs, isClient); err != nil {
+			return nil, err
+		}
+	}
+
 	var rip RequestIP
-	for p.Next() {
-		switch p.Key() {
+	for _, p := range pairs {
+		switch p.Key {
 		case "ip":
-			rip.IPs = append(rip.IPs, p.IPNet())
+			ip, err := parseIPNet(p.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			rip.IPs = append(rip.IPs, ip)
 		case "leasestart":
-			rip.LeaseStart = time.Unix(int64(p.Int()), 0)
+			v, err := strconv.Atoi(p.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			rip.LeaseStart = time.Unix(int64(v), 0)
 		case "leasetime":
-			rip.LeaseTime = time.Duration(p.Int()) * time.Second
+			v, err := strconv.Atoi(p.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			rip.LeaseTime = time.Duration(v) * time.Second
+		case "request_ip":
+			// Servers may echo the command header in their response, which
+			// is not an extension.
+		default:
+			rip.Extensions = append(rip.Extensions, p)
 		}
 	}
 
-	if err := p.Err(); err != nil {
-		return nil, err
+	return &rip, nil
+}
+
+// checkExtension verifies that p can be sent as an extension key/value pair
+// without corrupting the message.
+func checkExtension(p Pair) error {
+	switch p.Key {
+	case "request_ip", "ip", "leasestart", "leasetime":
+		return fmt.Errorf("wgdynamic: invalid extension key: %q", p.Key)
 	}
 
-	return &rip, nil
+	return checkPair(p)
+}
+
+// maxLeaseTime is the maximum number of seconds which can be represented by a
+// time.Duration.
+const maxLeaseTime = int64(math.MaxInt64 / time.Second)
+
+// validateRequestIP strictly validates the key/value pairs of a request_ip
+// command or response. It rejects unknown or duplicate keys, negative or
+// overflowing integers, addresses which are not hosts within their prefix, and
+// keys which are not valid for the sender as indicated by isClient. Errors
+// name the offending line.
+func validateRequestIP(pairs []Pair, isClient bool) error {
+	var (
+		seen = make(map[string]bool)
+		ips  = make(map[string]bool)
+	)
+
+	for i, p := range pairs {
+		lineErr := func(format string, v ...interface{}) error {
+			return fmt.Errorf("wgdynamic: strict: line %q: %s", p.Key+"="+p.Value, fmt.Sprintf(format, v...))
+		}
+
+		switch p.Key {
+		case "request_ip":
+			// Servers may echo the command header as the first line of
+			// their response.
+			if isClient || i != 0 {
+				return lineErr("unexpected command header")
+			}
+
+			continue
+		case "ip":
+			ip, ipn, err := net.ParseCIDR(p.Value)
+			if err != nil {
+				return lineErr("invalid address: %v", err)
+			}
+
+			ones, bits := ipn.Mask.Size()
+			if bits-ones > 1 && ip.Equal(ipn.IP) {
+				return lineErr("address is a network prefix, not a host")
+			}
+
+			if ips[ip.String()] {
+				return lineErr("duplicate address")
+			}
+			ips[ip.String()] = true
+
+			continue
+		case "leasestart":
+			if isClient {
+				return lineErr("key is only valid in server responses")
+			}
+		case "leasetime":
+		default:
+			return lineErr("unknown key")
+		}
+
+		// Both leasestart and leasetime are non-negative integers which may
+		// only appear once.
+		if seen[p.Key] {
+			return lineErr("duplicate key")
+		}
+		seen[p.Key] = true
+
+		v, err := strconv.ParseInt(p.Value, 10, 64)
+		if err != nil {
+			return lineErr("invalid integer: %v", err)
+		}
+		if v < 0 {
+			return lineErr("negative value")
+		}
+		if p.Key == "leasetime" && v > maxLeaseTime {
+			return lineErr("value overflows lease duration")
+		}
+	}
+
+	return nil
 }
 
-// parseRequest begins the parsing process for reading a client request, returning
-// a kvParser and the command being performed.
-func parseRequest(r io.Reader) (*kvParser, string, error) {
-	// Consume the first line to retrieve the command.
-	p := newKVParser(r)
-	if !p.Next() {
-		return nil, "", p.Err()
+// errBadVersion indicates that a request specified an invalid protocol version.
+var errBadVersion = errors.New("wgdynamic: invalid protocol version")
+
+// parseRequest parses a client request, returning the command being performed,
+// its protocol version, and its key/value pairs. The request must not exceed l.
+func parseRequest(r io.Reader, l limits) (*Request, error) {
+	d := &Decoder{p: newLimitedKVParser(r, l)}
+	m, err := d.Decode()
+	switch {
+	case err == io.EOF, err == nil && m.Command == "":
+		return nil, errors.New("wgdynamic: empty request")
+	case err != nil:
+		return nil, err
 	}
 
-	return p, p.Key(), nil
+	return &Request{
+		Command: m.Command,
+		Version: m.Version,
+		Pairs:   m.Pairs,
+	}, nil
 }
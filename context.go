@@ -0,0 +1,41 @@
+package wgdynamic
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// RequestInfo contains metadata about a request received by a Server. It is
+// attached to the context of each Request.
+type RequestInfo struct {
+	// Addr is the network address of the client which sent the request.
+	Addr net.Addr
+
+	// Interface is the name of the network interface the request was received
+	// on, if known.
+	Interface string
+
+	// Peer is the WireGuard peer which sent the request. It is only set when
+	// Server.PeerResolver is configured and the peer was resolved
+	// successfully.
+	Peer *Peer
+
+	// Received is the time at which the request was received.
+	Received time.Time
+}
+
+// requestInfoKey is the context key for a *RequestInfo.
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns the RequestInfo attached to ctx by a Server,
+// if present.
+func RequestInfoFromContext(ctx context.Context) (*RequestInfo, bool) {
+	ri, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return ri, ok
+}
+
+// withRequestInfo returns a copy of ctx which carries ri.
+func withRequestInfo(ctx context.Context, ri *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, ri)
+}
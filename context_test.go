@@ -0,0 +1,212 @@
+package wgdynamic_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestServerRequestContext(t *testing.T) {
+	tests := []struct {
+		name string
+		s    *wgdynamic.Server
+		// cancel cancels the client's request after the handler starts, or
+		// closes the server.
+		cancel func(s *wgdynamic.Server, cancel func())
+		err    error
+	}{
+		{
+			name: "client disconnect",
+			s:    &wgdynamic.Server{},
+			cancel: func(_ *wgdynamic.Server, cancel func()) {
+				cancel()
+			},
+			err: context.Canceled,
+		},
+		{
+			name: "handler timeout",
+			s: &wgdynamic.Server{
+				HandlerTimeout: 50 * time.Millisecond,
+			},
+			cancel: func(_ *wgdynamic.Server, _ func()) {},
+			err:    wgdynamic.ErrInvalidRequest,
+		},
+		{
+			name: "server closed",
+			s:    &wgdynamic.Server{},
+			cancel: func(s *wgdynamic.Server, _ func()) {
+				go s.Close()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				startC = make(chan struct{})
+				doneC  = make(chan error, 1)
+				infoC  = make(chan *wgdynamic.RequestInfo, 1)
+			)
+
+			tt.s.RequestIPContext = func(ctx context.Context, _ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+				ri, ok := wgdynamic.RequestInfoFromContext(ctx)
+				if !ok {
+					panicf("no RequestInfo in context")
+				}
+				infoC <- ri
+
+				close(startC)
+
+				select {
+				case <-ctx.Done():
+					doneC <- ctx.Err()
+					return nil, ctx.Err()
+				case <-time.After(5 * time.Second):
+					doneC <- nil
+					return nil, wgdynamic.ErrIPUnavailable
+				}
+			}
+
+			c, done := testServer(t, tt.s)
+			defer done()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			errC := make(chan error, 1)
+			go func() {
+				_, err := c.RequestIP(ctx, nil)
+				errC <- err
+			}()
+
+			<-startC
+			tt.cancel(tt.s, cancel)
+
+			if err := <-doneC; err == nil {
+				t.Fatal("handler context was not canceled")
+			}
+
+			// The server closing the connection does not produce a
+			// consistent client error, so only check that one occurred.
+			err := <-errC
+			if tt.err == nil {
+				if err == nil {
+					t.Fatal("expected a client error, but none occurred")
+				}
+			} else if diff := cmp.Diff(tt.err.Error(), fmt.Sprint(err)); diff != "" {
+				t.Fatalf("unexpected client error (-want +got):\n%s", diff)
+			}
+
+			ri := <-infoC
+			if ri.Addr == nil || ri.Received.IsZero() {
+				t.Fatalf("RequestInfo fields were not set: %+v", ri)
+			}
+		})
+	}
+}
+
+func TestServerRequestContextClientClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// close ends the client's side of the connection after it sends a
+		// request, and reports whether the client awaits the response.
+		close func(c *net.TCPConn) bool
+		err   error
+	}{
+		{
+			name: "close write",
+			close: func(c *net.TCPConn) bool {
+				if err := c.CloseWrite(); err != nil {
+					panicf("failed to close write: %v", err)
+				}
+				return true
+			},
+		},
+		{
+			// A normal close cannot be distinguished from a half-close, so
+			// the request is not canceled.
+			name: "close",
+			close: func(c *net.TCPConn) bool {
+				_ = c.Close()
+				return false
+			},
+		},
+		{
+			name: "reset",
+			close: func(c *net.TCPConn) bool {
+				_ = c.SetLinger(0)
+				_ = c.Close()
+				return false
+			},
+			err: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				startC = make(chan struct{})
+				errC   = make(chan error, 1)
+			)
+
+			s := &wgdynamic.Server{
+				RequestIPContext: func(ctx context.Context, _ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+					close(startC)
+
+					// Give the server time to observe the client's close.
+					select {
+					case <-ctx.Done():
+						errC <- ctx.Err()
+						return nil, ctx.Err()
+					case <-time.After(200 * time.Millisecond):
+						errC <- nil
+						return &wgdynamic.RequestIP{
+							IPs:       []*net.IPNet{mustIPNet("192.0.2.1/32")},
+							LeaseTime: 10 * time.Second,
+						}, nil
+					}
+				},
+			}
+
+			c, done := testServer(t, s)
+			defer done()
+
+			conn, err := c.Dial(context.Background())
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+
+			if _, err := io.WriteString(conn, "request_ip=1\n\n"); err != nil {
+				t.Fatalf("failed to write request: %v", err)
+			}
+
+			<-startC
+			wait := tt.close(conn.(*net.TCPConn))
+
+			if diff := cmp.Diff(fmt.Sprint(tt.err), fmt.Sprint(<-errC)); diff != "" {
+				t.Fatalf("unexpected handler context error (-want +got):\n%s", diff)
+			}
+
+			if !wait {
+				return
+			}
+
+			b, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+
+			if !strings.Contains(string(b), "ip=192.0.2.1/32\n") {
+				t.Fatalf("unexpected response:\n%s", b)
+			}
+		})
+	}
+}
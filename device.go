@@ -0,0 +1,251 @@
+package wgdynamic
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// A Device provides access to the peers of WireGuard interfaces. Most callers
+// should use NewWGCtrlDevice to access the operating system's WireGuard
+// interfaces, or NewMemoryDevice in tests.
+type Device interface {
+	// Peers returns the peers configured on the WireGuard interface iface.
+	Peers(iface string) ([]wgtypes.Peer, error)
+
+	// AddAllowedIPs adds ips to the allowed IPs of the peer identified by
+	// key on the WireGuard interface iface.
+	AddAllowedIPs(iface string, key wgtypes.Key, ips []net.IPNet) error
+
+	// RemoveAllowedIPs removes ips from the allowed IPs of the peer
+	// identified by key on the WireGuard interface iface.
+	RemoveAllowedIPs(iface string, key wgtypes.Key, ips []net.IPNet) error
+}
+
+var (
+	_ Device = &WGCtrlDevice{}
+	_ Device = &MemoryDevice{}
+)
+
+// A WGCtrlDevice is a Device which accesses the operating system's WireGuard
+// interfaces using wgctrl.
+type WGCtrlDevice struct {
+	// mu serializes modifications so that RemoveAllowedIPs cannot discard
+	// addresses added concurrently while it replaces a peer's allowed IPs.
+	mu sync.Mutex
+	c  *wgctrl.Client
+}
+
+// NewWGCtrlDevice creates a WGCtrlDevice. Call Close to release its
+// resources.
+func NewWGCtrlDevice() (*WGCtrlDevice, error) {
+	c, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WGCtrlDevice{c: c}, nil
+}
+
+// Close releases the WGCtrlDevice's resources.
+func (d *WGCtrlDevice) Close() error { return d.c.Close() }
+
+// Peers implements Device.
+func (d *WGCtrlDevice) Peers(iface string) ([]wgtypes.Peer, error) {
+	dev, err := d.c.Device(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	return dev.Peers, nil
+}
+
+// AddAllowedIPs implements Device.
+func (d *WGCtrlDevice) AddAllowedIPs(iface string, key wgtypes.Key, ips []net.IPNet) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.c.ConfigureDevice(iface, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:  key,
+			UpdateOnly: true,
+			AllowedIPs: ips,
+		}},
+	})
+}
+
+// RemoveAllowedIPs implements Device.
+func (d *WGCtrlDevice) RemoveAllowedIPs(iface string, key wgtypes.Key, ips []net.IPNet) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// WireGuard has no way to remove individual allowed IPs, so replace the
+	// peer's allowed IPs with all but the ones being removed.
+	peers, err := d.Peers(iface)
+	if err != nil {
+		return err
+	}
+
+	p, err := findPeer(iface, peers, key)
+	if err != nil {
+		return err
+	}
+
+	return d.c.ConfigureDevice(iface, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:         key,
+			UpdateOnly:        true,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        removeIPNets(p.AllowedIPs, ips),
+		}},
+	})
+}
+
+// A MemoryDevice is an in-memory Device which is useful for tests.
+type MemoryDevice struct {
+	mu    sync.Mutex
+	peers map[string][]wgtypes.Peer
+}
+
+// NewMemoryDevice creates an empty MemoryDevice.
+func NewMemoryDevice() *MemoryDevice {
+	return &MemoryDevice{
+		peers: make(map[string][]wgtypes.Peer),
+	}
+}
+
+// SetPeers creates or replaces the WireGuard interface iface with the input
+// peers.
+func (d *MemoryDevice) SetPeers(iface string, peers []wgtypes.Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.peers[iface] = clonePeers(peers)
+}
+
+// Peers implements Device. If iface was not created using SetPeers, an error
+// compatible with os.IsNotExist is returned.
+func (d *MemoryDevice) Peers(iface string) ([]wgtypes.Peer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers, ok := d.peers[iface]
+	if !ok {
+		return nil, errNoInterface(iface)
+	}
+
+	return clonePeers(peers), nil
+}
+
+// AddAllowedIPs implements Device. Addresses which are already present in the
+// peer's allowed IPs are not added again.
+func (d *MemoryDevice) AddAllowedIPs(iface string, key wgtypes.Key, ips []net.IPNet) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, err := d.peer(iface, key)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		if !containsIPNet(p.AllowedIPs, ip) {
+			p.AllowedIPs = append(p.AllowedIPs, ip)
+		}
+	}
+
+	return nil
+}
+
+// RemoveAllowedIPs implements Device.
+func (d *MemoryDevice) RemoveAllowedIPs(iface string, key wgtypes.Key, ips []net.IPNet) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p, err := d.peer(iface, key)
+	if err != nil {
+		return err
+	}
+
+	p.AllowedIPs = removeIPNets(p.AllowedIPs, ips)
+	return nil
+}
+
+// peer returns a pointer to the peer identified by key on iface. d.mu must be
+// held when calling peer.
+func (d *MemoryDevice) peer(iface string, key wgtypes.Key) (*wgtypes.Peer, error) {
+	peers, ok := d.peers[iface]
+	if !ok {
+		return nil, errNoInterface(iface)
+	}
+
+	return findPeer(iface, peers, key)
+}
+
+// errNoInterface returns an error compatible with os.IsNotExist for a missing
+// WireGuard interface.
+func errNoInterface(iface string) error {
+	return &os.PathError{
+		Op:   "peers",
+		Path: iface,
+		Err:  os.ErrNotExist,
+	}
+}
+
+// findPeer returns a pointer to the peer identified by key in peers.
+func findPeer(iface string, peers []wgtypes.Peer, key wgtypes.Key) (*wgtypes.Peer, error) {
+	for i := range peers {
+		if peers[i].PublicKey == key {
+			return &peers[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("wgdynamic: no peer %s on interface %q", key, iface)
+}
+
+// removeIPNets returns the addresses in ips which are not present in remove.
+func removeIPNets(ips, remove []net.IPNet) []net.IPNet {
+	out := make([]net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		if !containsIPNet(remove, ip) {
+			out = append(out, ip)
+		}
+	}
+
+	return out
+}
+
+// containsIPNet reports whether ip is present in ips.
+func containsIPNet(ips []net.IPNet, ip net.IPNet) bool {
+	for _, v := range ips {
+		if v.String() == ip.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clonePeers produces a copy of peers which shares no AllowedIPs memory with
+// the input.
+func clonePeers(peers []wgtypes.Peer) []wgtypes.Peer {
+	out := make([]wgtypes.Peer, 0, len(peers))
+	for _, p := range peers {
+		ips := make([]net.IPNet, 0, len(p.AllowedIPs))
+		for _, ip := range p.AllowedIPs {
+			ips = append(ips, net.IPNet{
+				IP:   append(net.IP(nil), ip.IP...),
+				Mask: append(net.IPMask(nil), ip.Mask...),
+			})
+		}
+
+		p.AllowedIPs = ips
+		out = append(out, p)
+	}
+
+	return out
+}
@@ -1,6 +1,13 @@
 package wgdynamic
 
-import "fmt"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 // wg-dynamic defines 0 as "success", but we handle success with nil error
 // in Go.
@@ -33,3 +40,180 @@ type Error struct {
 func (e *Error) Error() string {
 	return fmt.Sprintf("wgdynamic: error %d: %s", e.Number, e.Message)
 }
+
+// Is reports whether target is an *Error with the same Number as e, so that
+// errors.Is matches protocol errors by number regardless of their messages.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+
+	return e.Number == t.Number
+}
+
+// errorRegistry contains all registered protocol errors by number.
+var errorRegistry = struct {
+	mu sync.RWMutex
+	m  map[int]*Error
+}{
+	m: map[int]*Error{
+		ErrInvalidRequest.Number:      ErrInvalidRequest,
+		ErrUnsupportedProtocol.Number: ErrUnsupportedProtocol,
+		ErrIPUnavailable.Number:       ErrIPUnavailable,
+	},
+}
+
+// RegisterError registers an application-specific protocol error with the
+// specified number and canonical message, and returns it for use as a
+// sentinel error value. RegisterError is typically called during package
+// initialization.
+//
+// When a Client receives a protocol error with a registered number and its
+// canonical message, the registered *Error is returned, so it may be compared
+// directly. Errors with the same number but a different message can be
+// matched using errors.Is.
+//
+// RegisterError panics if number is not positive or is already registered,
+// including by the predefined errors in this package.
+func RegisterError(number int, message string) *Error {
+	if number <= 0 {
+		panicf("wgdynamic: invalid error number: %d", number)
+	}
+
+	errorRegistry.mu.Lock()
+	defer errorRegistry.mu.Unlock()
+
+	if _, ok := errorRegistry.m[number]; ok {
+		panicf("wgdynamic: error number %d is already registered", number)
+	}
+
+	e := &Error{
+		Number:  number,
+		Message: message,
+	}
+	errorRegistry.m[number] = e
+
+	return e
+}
+
+// registeredError returns the registered *Error which matches e exactly, or
+// e itself if there is none.
+func registeredError(e *Error) *Error {
+	errorRegistry.mu.RLock()
+	defer errorRegistry.mu.RUnlock()
+
+	if re, ok := errorRegistry.m[e.Number]; ok && re.Message == e.Message {
+		return re
+	}
+
+	return e
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, producing the errno and
+// errmsg key/value pairs of a wg-dynamic protocol error. Any characters in
+// Message which could corrupt the key/value stream, such as newlines and
+// "=", are escaped.
+func (e *Error) MarshalBinary() ([]byte, error) {
+	if e.Number <= 0 {
+		return nil, fmt.Errorf("wgdynamic: invalid error number: %d", e.Number)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("errno=")
+	b.WriteString(strconv.Itoa(e.Number))
+	b.WriteString("\nerrmsg=")
+	b.WriteString(escapeValue(e.Message))
+	b.WriteString("\n")
+
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, parsing the errno and
+// errmsg key/value pairs produced by MarshalBinary.
+func (e *Error) UnmarshalBinary(b []byte) error {
+	p := newKVParser(bytes.NewReader(b))
+	if p.Next() {
+		// Only errno and errmsg are permitted, and they are consumed
+		// internally by the parser.
+		return fmt.Errorf("wgdynamic: unexpected key %q in error", p.Key())
+	}
+
+	werr := p.Err()
+	if werr == nil {
+		return errors.New("wgdynamic: no error number present")
+	}
+
+	perr, ok := werr.(*Error)
+	if !ok {
+		return werr
+	}
+
+	*e = *perr
+	return nil
+}
+
+// escapeValue escapes s so it can be safely sent as the value of a key/value
+// pair. Backslashes, "=", and all control characters are replaced by escape
+// sequences.
+func escapeValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '=' || c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// unescapeValue reverses escapeValue. Unrecognized escape sequences are
+// preserved as-is for compatibility with peers which do not escape values.
+func unescapeValue(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		switch s[i+1] {
+		case '\\':
+			b.WriteByte('\\')
+			i++
+		case 'n':
+			b.WriteByte('\n')
+			i++
+		case 'r':
+			b.WriteByte('\r')
+			i++
+		case 'x':
+			if i+3 < len(s) {
+				if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+					b.WriteByte(byte(v))
+					i += 3
+					continue
+				}
+			}
+
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,280 @@
+package wgdynamic_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestErrorMarshalBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		e    *wgdynamic.Error
+		b    string
+		ok   bool
+	}{
+		{
+			name: "invalid number",
+			e:    &wgdynamic.Error{Message: "success?"},
+		},
+		{
+			name: "OK",
+			e:    wgdynamic.ErrIPUnavailable,
+			b:    "errno=3\nerrmsg=Chosen IP(s) unavailable\n",
+			ok:   true,
+		},
+		{
+			name: "OK injection",
+			e: &wgdynamic.Error{
+				Number:  1,
+				Message: "oops\n\nip=192.0.2.1/32\r\nerrno=0\\n",
+			},
+			b:  `errmsg=oops\n\nip\x3d192.0.2.1/32\r\nerrno\x3d0\\n`,
+			ok: true,
+		},
+		{
+			name: "OK control characters",
+			e: &wgdynamic.Error{
+				Number:  2,
+				Message: "a\x00b\tc\x7f",
+			},
+			b:  `errmsg=a\x00b\x09c\x7f`,
+			ok: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.e.MarshalBinary()
+			if tt.ok && err != nil {
+				t.Fatalf("failed to marshal: %v", err)
+			}
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected an error, but none occurred")
+				}
+
+				return
+			}
+
+			// The output must always be exactly two key/value pairs.
+			lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("unexpected number of lines: %q", lines)
+			}
+			for _, l := range lines {
+				if strings.Count(l, "=") != 1 {
+					t.Fatalf("malformed key/value pair: %q", l)
+				}
+			}
+
+			if !strings.Contains(string(b), tt.b) {
+				t.Fatalf("unexpected output:\n got: %q\nwant: %q", string(b), tt.b)
+			}
+
+			var e wgdynamic.Error
+			if err := e.UnmarshalBinary(b); err != nil {
+				t.Fatalf("failed to unmarshal: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.e, &e); diff != "" {
+				t.Fatalf("unexpected Error (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestErrorUnmarshalBinaryErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "extra key",
+			b:    "errno=1\nip=192.0.2.1/32\n",
+		},
+		{
+			name: "bad number",
+			b:    "errno=foo\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e wgdynamic.Error
+			if err := e.UnmarshalBinary([]byte(tt.b)); err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+		})
+	}
+}
+
+func TestServerErrorInjection(t *testing.T) {
+	want := &wgdynamic.Error{
+		Number:  3,
+		Message: "nope\nip=192.0.2.1/32\nleasetime=10\n\n",
+	}
+
+	c, done := testServer(t, &wgdynamic.Server{
+		RequestIP: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			return nil, want
+		},
+	})
+	defer done()
+
+	// The client must observe the exact protocol error and no assignment.
+	got, err := c.RequestIP(context.Background(), nil)
+	if got != nil {
+		t.Fatalf("unexpected RequestIP: %+v", got)
+	}
+
+	if diff := cmp.Diff(want, err); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+}
+
+// errCustom is an application-specific protocol error registered for tests.
+var errCustom = wgdynamic.RegisterError(100, "Custom error")
+
+func TestErrorIs(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		target error
+		ok     bool
+	}{
+		{
+			name:   "same number",
+			err:    &wgdynamic.Error{Number: 3, Message: "Out of IPs"},
+			target: wgdynamic.ErrIPUnavailable,
+			ok:     true,
+		},
+		{
+			name:   "wrapped",
+			err:    fmt.Errorf("request failed: %w", &wgdynamic.Error{Number: 1}),
+			target: wgdynamic.ErrInvalidRequest,
+			ok:     true,
+		},
+		{
+			name:   "different number",
+			err:    &wgdynamic.Error{Number: 2, Message: "Chosen IP(s) unavailable"},
+			target: wgdynamic.ErrIPUnavailable,
+		},
+		{
+			name:   "not an Error",
+			err:    errors.New("Invalid request"),
+			target: wgdynamic.ErrInvalidRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.ok, errors.Is(tt.err, tt.target)); diff != "" {
+				t.Fatalf("unexpected errors.Is result (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRegisterErrorPanics(t *testing.T) {
+	tests := []struct {
+		name   string
+		number int
+	}{
+		{
+			name: "zero",
+		},
+		{
+			name:   "predefined",
+			number: wgdynamic.ErrIPUnavailable.Number,
+		},
+		{
+			name:   "duplicate",
+			number: errCustom.Number,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatal("expected a panic, but none occurred")
+				}
+			}()
+
+			wgdynamic.RegisterError(tt.number, "foo")
+		})
+	}
+}
+
+func TestClientRegisteredErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *wgdynamic.Error
+		// same indicates that the client should return the registered error
+		// value itself.
+		same   bool
+		target error
+	}{
+		{
+			name:   "predefined",
+			err:    &wgdynamic.Error{Number: 3, Message: "Chosen IP(s) unavailable"},
+			same:   true,
+			target: wgdynamic.ErrIPUnavailable,
+		},
+		{
+			name:   "custom",
+			err:    &wgdynamic.Error{Number: 100, Message: "Custom error"},
+			same:   true,
+			target: errCustom,
+		},
+		{
+			name:   "custom different message",
+			err:    &wgdynamic.Error{Number: 100, Message: "Something else"},
+			target: errCustom,
+		},
+		{
+			name:   "unregistered",
+			err:    &wgdynamic.Error{Number: 101, Message: "Unknown"},
+			target: &wgdynamic.Error{Number: 101},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, done := testServer(t, &wgdynamic.Server{
+				RequestIP: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+					return nil, tt.err
+				},
+			})
+			defer done()
+
+			_, err := c.RequestIP(context.Background(), nil)
+			if !errors.Is(err, tt.target) {
+				t.Fatalf("expected error matching %v, but got: %v", tt.target, err)
+			}
+
+			if diff := cmp.Diff(tt.same, err == tt.target); diff != "" {
+				t.Fatalf("unexpected sentinel identity (-want +got):\n%s", diff)
+			}
+
+			var werr *wgdynamic.Error
+			if !errors.As(err, &werr) {
+				t.Fatalf("expected *Error, but got: %T", err)
+			}
+
+			if diff := cmp.Diff(tt.err, werr); diff != "" {
+				t.Fatalf("unexpected Error (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package wgdynamic
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// A Pair is a key/value pair in a wg-dynamic message.
+type Pair struct {
+	Key, Value string
+}
+
+// A Request is a wg-dynamic protocol request received by a Server.
+type Request struct {
+	// Command is the name of the command being performed, such as
+	// "request_ip".
+	Command string
+
+	// Version is the protocol version of the command, such as 1 for
+	// "request_ip=1". If zero, version 1 is assumed.
+	Version int
+
+	// Pairs are the key/value pairs which follow the command, in the order
+	// they were received.
+	Pairs []Pair
+
+	// Addr is the network address of the client which sent the request.
+	Addr net.Addr
+
+	// Interface is the name of the network interface the request was received
+	// on, if known. It is derived from the zone of the listener's address, as
+	// set by Listen.
+	Interface string
+
+	ctx    context.Context
+	strict bool
+}
+
+// Context returns the request's context. For requests received by a Server,
+// the context is canceled when the client's connection is reset or otherwise
+// fails, when the Handler times out, or when the Server is closed, including
+// when the context passed to Shutdown expires. The context carries a
+// *RequestInfo which can be retrieved using RequestInfoFromContext.
+//
+// A client which closes its connection normally cannot be distinguished from
+// one which has only shut down its side of the connection to await the
+// response, so a normal close does not cancel the context. A Client resets
+// its connection when the context of a request is canceled.
+//
+// If no context has been set, Context returns context.Background.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+// ctx must not be nil.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("wgdynamic: nil context")
+	}
+
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// A Handler responds to a wg-dynamic protocol request.
+//
+// ServeWGDynamic should write a response to w and return nil, or return an
+// error without writing a response. If the error is of type *Error, that
+// protocol error is returned to the client. For generic errors, a generic
+// protocol error is returned.
+type Handler interface {
+	ServeWGDynamic(w io.Writer, r *Request) error
+}
+
+// The HandlerFunc type is an adapter which allows the use of ordinary
+// functions as Handlers.
+type HandlerFunc func(w io.Writer, r *Request) error
+
+// ServeWGDynamic implements Handler.
+func (fn HandlerFunc) ServeWGDynamic(w io.Writer, r *Request) error { return fn(w, r) }
+
+var _ Handler = &ServeMux{}
+
+// A ServeMux is a wg-dynamic request multiplexer. It invokes the Handler
+// registered for the command and protocol version of each request, or
+// otherwise the Handler registered for the command regardless of version.
+//
+// If no Handler is registered for the command, ErrInvalidRequest is returned to
+// the client. If Handlers are registered only for other versions of the
+// command, ErrUnsupportedProtocol is returned to the client.
+type ServeMux struct {
+	mu sync.RWMutex
+	m  map[string]Handler
+	vm map[muxKey]Handler
+}
+
+// A muxKey is a key for a Handler registered for a specific command version.
+type muxKey struct {
+	command string
+	version int
+}
+
+// NewServeMux creates an empty ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{
+		m:  make(map[string]Handler),
+		vm: make(map[muxKey]Handler),
+	}
+}
+
+// Handle registers h as the Handler for command. Handle panics if command is
+// empty, h is nil, or a Handler is already registered for command.
+func (mux *ServeMux) Handle(command string, h Handler) {
+	if command == "" {
+		panic("wgdynamic: ServeMux command must not be empty")
+	}
+	if h == nil {
+		panicf("wgdynamic: nil Handler for command %q", command)
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if _, ok := mux.m[command]; ok {
+		panicf("wgdynamic: multiple registrations for command %q", command)
+	}
+
+	mux.m[command] = h
+}
+
+// HandleFunc registers fn as the Handler for command.
+func (mux *ServeMux) HandleFunc(command string, fn func(w io.Writer, r *Request) error) {
+	mux.Handle(command, HandlerFunc(fn))
+}
+
+// HandleVersion registers h as the Handler for a specific protocol version of
+// command. HandleVersion panics if command is empty, version is less than 1,
+// h is nil, or a Handler is already registered for that version of command.
+func (mux *ServeMux) HandleVersion(command string, version int, h Handler) {
+	if command == "" {
+		panic("wgdynamic: ServeMux command must not be empty")
+	}
+	if version < 1 {
+		panicf("wgdynamic: invalid version %d for command %q", version, command)
+	}
+	if h == nil {
+		panicf("wgdynamic: nil Handler for command %q version %d", command, version)
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	k := muxKey{command: command, version: version}
+	if _, ok := mux.vm[k]; ok {
+		panicf("wgdynamic: multiple registrations for command %q version %d", command, version)
+	}
+
+	mux.vm[k] = h
+}
+
+// ServeWGDynamic implements Handler.
+func (mux *ServeMux) ServeWGDynamic(w io.Writer, r *Request) error {
+	h, err := mux.handler(r.Command, version(r))
+	if err != nil {
+		return err
+	}
+
+	setDispatched(r.Context())
+	return h.ServeWGDynamic(w, r)
+}
+
+// handler returns the Handler for the specified command version.
+func (mux *ServeMux) handler(command string, version int) (Handler, error) {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	if h, ok := mux.vm[muxKey{command: command, version: version}]; ok {
+		return h, nil
+	}
+	if h, ok := mux.m[command]; ok {
+		return h, nil
+	}
+
+	// Is the command supported at all?
+	for k := range mux.vm {
+		if k.command == command {
+			return nil, ErrUnsupportedProtocol
+		}
+	}
+
+	return nil, ErrInvalidRequest
+}
+
+// handles reports whether a Handler is registered for the specified version of
+// command, either explicitly or for all versions.
+func (mux *ServeMux) handles(command string, version int) bool {
+	_, err := mux.handler(command, version)
+	return err == nil
+}
+
+// knows reports whether any Handler is registered for command, regardless of
+// version.
+func (mux *ServeMux) knows(command string) bool {
+	_, err := mux.handler(command, 0)
+	return err != ErrInvalidRequest
+}
+
+// dispatchKey is the context key for a *int32 which a ServeMux sets to 1 when
+// it dispatches a request to a registered Handler.
+type dispatchKey struct{}
+
+// withDispatch returns a copy of ctx which records whether a request was
+// dispatched by a ServeMux.
+func withDispatch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dispatchKey{}, new(int32))
+}
+
+// setDispatched records that the request with ctx was dispatched by a
+// ServeMux.
+func setDispatched(ctx context.Context) {
+	if d, ok := ctx.Value(dispatchKey{}).(*int32); ok {
+		atomic.StoreInt32(d, 1)
+	}
+}
+
+// dispatched reports whether the request with ctx was dispatched by a
+// ServeMux.
+func dispatched(ctx context.Context) bool {
+	d, ok := ctx.Value(dispatchKey{}).(*int32)
+	return ok && atomic.LoadInt32(d) == 1
+}
+
+// version returns the effective protocol version of r.
+func version(r *Request) int {
+	if r.Version == 0 {
+		return defaultVersion
+	}
+
+	return r.Version
+}
+
+// RequestIPHandler adapts a RequestIP function, with the same semantics as
+// Server.RequestIP, into a Handler for version 1 of the "request_ip" command.
+// Requests for other versions receive ErrUnsupportedProtocol.
+func RequestIPHandler(fn func(src net.Addr, r *RequestIP) (*RequestIP, error)) Handler {
+	if fn == nil {
+		return RequestIPContextHandler(nil)
+	}
+
+	return RequestIPContextHandler(func(_ context.Context, src net.Addr, r *RequestIP) (*RequestIP, error) {
+		return fn(src, r)
+	})
+}
+
+// RequestIPContextHandler adapts a RequestIP function, with the same semantics
+// as Server.RequestIPContext, into a Handler for version 1 of the "request_ip"
+// command. Requests for other versions receive ErrUnsupportedProtocol.
+func RequestIPContextHandler(fn func(ctx context.Context, src net.Addr, r *RequestIP) (*RequestIP, error)) Handler {
+	return HandlerFunc(func(w io.Writer, r *Request) error {
+		if fn == nil {
+			// Not implemented by caller.
+			return ErrInvalidRequest
+		}
+		if v := version(r); v != defaultVersion {
+			return ErrUnsupportedProtocol
+		}
+
+		req, err := parseRequestIP(r.Pairs, fromClient, r.strict)
+		if err != nil {
+			return err
+		}
+
+		res, err := fn(r.Context(), r.Addr, req)
+		if err != nil {
+			return err
+		}
+
+		return sendRequestIP(w, fromServer, defaultVersion, res)
+	})
+}
@@ -0,0 +1,218 @@
+package wgdynamic_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestServeMux(t *testing.T) {
+	mux := wgdynamic.NewServeMux()
+	mux.HandleFunc("echo", func(w io.Writer, r *wgdynamic.Request) error {
+		for _, p := range r.Pairs {
+			if _, err := io.WriteString(w, p.Key+"="+p.Value+"\n"); err != nil {
+				return err
+			}
+		}
+
+		_, err := io.WriteString(w, "\n")
+		return err
+	})
+
+	tests := []struct {
+		name string
+		r    *wgdynamic.Request
+		out  string
+		err  error
+	}{
+		{
+			name: "unknown command",
+			r:    &wgdynamic.Request{Command: "foo"},
+			err:  wgdynamic.ErrInvalidRequest,
+		},
+		{
+			name: "OK",
+			r: &wgdynamic.Request{
+				Command: "echo",
+				Pairs: []wgdynamic.Pair{
+					{Key: "hello", Value: "world"},
+					{Key: "foo", Value: "bar"},
+				},
+			},
+			out: "hello=world\nfoo=bar\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := mux.ServeWGDynamic(&b, tt.r)
+			if diff := cmp.Diff(tt.err, err); diff != "" {
+				t.Fatalf("unexpected error (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.out, b.String()); diff != "" {
+				t.Fatalf("unexpected output (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServeMuxVersions(t *testing.T) {
+	handler := func(s string) wgdynamic.Handler {
+		return wgdynamic.HandlerFunc(func(w io.Writer, _ *wgdynamic.Request) error {
+			_, err := io.WriteString(w, s)
+			return err
+		})
+	}
+
+	mux := wgdynamic.NewServeMux()
+	mux.HandleVersion("foo", 1, handler("foo v1"))
+	mux.HandleVersion("foo", 2, handler("foo v2"))
+	mux.HandleVersion("bar", 2, handler("bar v2"))
+	mux.Handle("bar", handler("bar"))
+
+	tests := []struct {
+		name string
+		r    *wgdynamic.Request
+		out  string
+		err  error
+	}{
+		{
+			name: "foo default version",
+			r:    &wgdynamic.Request{Command: "foo"},
+			out:  "foo v1",
+		},
+		{
+			name: "foo v2",
+			r:    &wgdynamic.Request{Command: "foo", Version: 2},
+			out:  "foo v2",
+		},
+		{
+			name: "foo unsupported",
+			r:    &wgdynamic.Request{Command: "foo", Version: 3},
+			err:  wgdynamic.ErrUnsupportedProtocol,
+		},
+		{
+			name: "bar v2",
+			r:    &wgdynamic.Request{Command: "bar", Version: 2},
+			out:  "bar v2",
+		},
+		{
+			name: "bar any version",
+			r:    &wgdynamic.Request{Command: "bar", Version: 3},
+			out:  "bar",
+		},
+		{
+			name: "unknown command",
+			r:    &wgdynamic.Request{Command: "baz", Version: 1},
+			err:  wgdynamic.ErrInvalidRequest,
+		},
+		{
+			name: "request_ip unsupported",
+			r:    &wgdynamic.Request{Command: "request_ip", Version: 2},
+			err:  wgdynamic.ErrUnsupportedProtocol,
+		},
+	}
+
+	// RequestIPHandler only supports version 1 even when registered for all
+	// versions.
+	mux.Handle("request_ip", wgdynamic.RequestIPHandler(func(_ net.Addr, r *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+		return r, nil
+	}))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := mux.ServeWGDynamic(&b, tt.r)
+			if diff := cmp.Diff(tt.err, err); diff != "" {
+				t.Fatalf("unexpected error (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.out, b.String()); diff != "" {
+				t.Fatalf("unexpected output (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServeMuxHandlePanics(t *testing.T) {
+	h := wgdynamic.RequestIPHandler(nil)
+
+	tests := []struct {
+		name string
+		fn   func(mux *wgdynamic.ServeMux)
+	}{
+		{
+			name: "empty command",
+			fn: func(mux *wgdynamic.ServeMux) {
+				mux.Handle("", h)
+			},
+		},
+		{
+			name: "nil handler",
+			fn: func(mux *wgdynamic.ServeMux) {
+				mux.Handle("request_ip", nil)
+			},
+		},
+		{
+			name: "duplicate",
+			fn: func(mux *wgdynamic.ServeMux) {
+				mux.Handle("request_ip", h)
+				mux.Handle("request_ip", h)
+			},
+		},
+		{
+			name: "bad version",
+			fn: func(mux *wgdynamic.ServeMux) {
+				mux.HandleVersion("request_ip", 0, h)
+			},
+		},
+		{
+			name: "duplicate version",
+			fn: func(mux *wgdynamic.ServeMux) {
+				mux.HandleVersion("request_ip", 1, h)
+				mux.HandleVersion("request_ip", 1, h)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatal("expected a panic, but none occurred")
+				}
+			}()
+
+			tt.fn(wgdynamic.NewServeMux())
+		})
+	}
+}
+
+func TestRequestIPHandler(t *testing.T) {
+	h := wgdynamic.RequestIPHandler(func(src net.Addr, r *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+		if diff := cmp.Diff([]*net.IPNet{mustIPNet("192.0.2.1/32")}, r.IPs); diff != "" {
+			panicf("unexpected IPs (-want +got):\n%s", diff)
+		}
+
+		return r, nil
+	})
+
+	var b bytes.Buffer
+	err := h.ServeWGDynamic(&b, &wgdynamic.Request{
+		Command: "request_ip",
+		Pairs:   []wgdynamic.Pair{{Key: "ip", Value: "192.0.2.1/32"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to serve: %v", err)
+	}
+
+	if diff := cmp.Diff("ip=192.0.2.1/32\n\n", b.String()); diff != "" {
+		t.Fatalf("unexpected output (-want +got):\n%s", diff)
+	}
+}
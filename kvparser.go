@@ -2,6 +2,7 @@ package wgdynamic
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -9,25 +10,97 @@ import (
 	"strings"
 )
 
+// Default limits applied to requests parsed by a Server.
+const (
+	defaultMaxLineLength = 1024
+	defaultMaxPairs      = 64
+	defaultMaxIPs        = 16
+)
+
+// errTooLarge indicates that a message exceeded the limits of a kvParser.
+var errTooLarge = errors.New("wgdynamic: message exceeds size limits")
+
+// limits specifies bounds on the size of a message parsed by a kvParser.
+// Zero values indicate no limit, other than the maximum line length of a
+// bufio.Scanner.
+type limits struct {
+	MaxLineLength, MaxPairs, MaxIPs int
+}
+
+// withDefaults returns a copy of l with any unset limits populated with
+// their defaults.
+func (l limits) withDefaults() limits {
+	if l.MaxLineLength <= 0 {
+		l.MaxLineLength = defaultMaxLineLength
+	}
+	if l.MaxPairs <= 0 {
+		l.MaxPairs = defaultMaxPairs
+	}
+	if l.MaxIPs <= 0 {
+		l.MaxIPs = defaultMaxIPs
+	}
+
+	return l
+}
+
 // A kvParser parses streams of key=value pairs.
 type kvParser struct {
 	s    *bufio.Scanner
+	l    limits
 	err  error
 	werr Error
 	k, v string
+
+	// Counts of pairs and IP addresses parsed so far in the current message,
+	// and whether the message's terminating blank line was reached.
+	pairs, ips int
+	done       bool
 }
 
-// newKVParser creates a kvParser that reads from r.
+// newKVParser creates a kvParser that reads from r with no limits.
 func newKVParser(r io.Reader) *kvParser {
+	return newLimitedKVParser(r, limits{})
+}
+
+// newLimitedKVParser creates a kvParser that reads from r and enforces l.
+func newLimitedKVParser(r io.Reader, l limits) *kvParser {
+	s := bufio.NewScanner(r)
+	if l.MaxLineLength > 0 {
+		// The scanner's buffer must also accommodate the trailing newline,
+		// and its initial capacity must not exceed the maximum or the
+		// maximum is ignored.
+		n := l.MaxLineLength + 1
+		size := 4096
+		if size > n {
+			size = n
+		}
+
+		s.Buffer(make([]byte, 0, size), n)
+	}
+
 	return &kvParser{
-		s: bufio.NewScanner(r),
+		s: s,
+		l: l,
 	}
 }
 
+// reset prepares p to parse the next message from its input.
+func (p *kvParser) reset() {
+	p.werr = Error{}
+	p.k, p.v = "", ""
+	p.pairs, p.ips = 0, 0
+	p.done = false
+}
+
 // Next advances to the next key=value pair if possible.
 func (p *kvParser) Next() bool {
-	if p.err != nil || !p.s.Scan() || p.s.Text() == "" {
-		// Hit an error, no more input, or we've reached the end of input.
+	if p.err != nil || !p.s.Scan() {
+		// Hit an error or no more input.
+		return false
+	}
+	if p.s.Text() == "" {
+		// We've reached the end of the message.
+		p.done = true
 		return false
 	}
 
@@ -40,6 +113,20 @@ func (p *kvParser) Next() bool {
 	// Set up internal state for calling other functions.
 	p.k, p.v = kvs[0], kvs[1]
 
+	// Enforce limits before handing the pair to the caller.
+	p.pairs++
+	if p.l.MaxPairs > 0 && p.pairs > p.l.MaxPairs {
+		p.err = fmt.Errorf("%w: more than %d key/value pairs", errTooLarge, p.l.MaxPairs)
+		return false
+	}
+	if p.k == "ip" {
+		p.ips++
+		if p.l.MaxIPs > 0 && p.ips > p.l.MaxIPs {
+			p.err = fmt.Errorf("%w: more than %d IP addresses", errTooLarge, p.l.MaxIPs)
+			return false
+		}
+	}
+
 	// Handle any errors internally and recursively call Next so that the caller
 	// does not observe any error key/value pairs.
 	switch p.k {
@@ -47,7 +134,7 @@ func (p *kvParser) Next() bool {
 		p.werr.Number = p.Int()
 		return p.Next()
 	case "errmsg":
-		p.werr.Message = p.String()
+		p.werr.Message = unescapeValue(p.String())
 		return p.Next()
 	}
 
@@ -87,24 +174,39 @@ func (p *kvParser) IPNet() *net.IPNet {
 		return nil
 	}
 
-	ip, ipn, err := net.ParseCIDR(p.v)
+	ipn, err := parseIPNet(p.v)
 	if err != nil {
 		p.err = err
 		return nil
 	}
 
+	return ipn
+}
+
+// parseIPNet parses s as a *net.IPNet which retains the full IP address rather
+// than only the network address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	ip, ipn, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+
 	// We want to return the actual allocated IP address along with its proper
 	// subnet mask, so replace the first network address with the actual IP
 	// address.
 	ipn.IP = ip
 
-	return ipn
+	return ipn, nil
 }
 
 // Err returns any errors encountered during parsing.
 func (p *kvParser) Err() error {
 	// First, errors from the underlying scanner.
 	if err := p.s.Err(); err != nil {
+		if err == bufio.ErrTooLong && p.l.MaxLineLength > 0 {
+			return fmt.Errorf("%w: line exceeds %d bytes", errTooLarge, p.l.MaxLineLength)
+		}
+
 		return err
 	}
 
@@ -113,9 +215,11 @@ func (p *kvParser) Err() error {
 		return p.err
 	}
 
-	// Finally, any protocol errors which may have been encountered.
+	// Finally, any protocol errors which may have been encountered, using
+	// the registered sentinel value when one matches.
 	if p.werr.Number != 0 {
-		return &p.werr
+		werr := p.werr
+		return registeredError(&werr)
 	}
 
 	return nil
@@ -1,6 +1,7 @@
 package wgdynamic
 
 import (
+	"errors"
 	"strings"
 	"testing"
 )
@@ -53,3 +54,60 @@ func Test_kvParserError(t *testing.T) {
 		})
 	}
 }
+
+func Test_kvParserLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		l    limits
+		ok   bool
+	}{
+		{
+			name: "OK unlimited",
+			s:    "request_ip=1\n" + strings.Repeat("ip=192.0.2.1/32\n", 100) + "\n",
+			ok:   true,
+		},
+		{
+			name: "line length",
+			s:    "request_ip=1\nip=192.0.2.1/32\n\n",
+			l:    limits{MaxLineLength: 14},
+		},
+		{
+			name: "pairs",
+			s:    "request_ip=1\nleasetime=10\nleasetime=10\n\n",
+			l:    limits{MaxPairs: 2},
+		},
+		{
+			name: "IPs",
+			s:    "request_ip=1\nip=192.0.2.1/32\nip=2001:db8::1/128\n\n",
+			l:    limits{MaxIPs: 1},
+		},
+		{
+			name: "OK at limits",
+			s:    "request_ip=1\nip=192.0.2.1/32\n\n",
+			l:    limits{MaxLineLength: 15, MaxPairs: 2, MaxIPs: 1},
+			ok:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newLimitedKVParser(strings.NewReader(tt.s), tt.l)
+			for p.Next() {
+			}
+
+			err := p.Err()
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("failed to parse: %v", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, errTooLarge) {
+				t.Fatalf("expected errTooLarge, but got: %v", err)
+			}
+		})
+	}
+}
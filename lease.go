@@ -0,0 +1,50 @@
+package wgdynamic
+
+import (
+	"net"
+	"time"
+)
+
+// A Lease is a record of IP addresses assigned to a client.
+type Lease struct {
+	// Client identifies the client which holds the lease. Leases created by
+	// this package identify clients by their source IP address and zone, such
+	// as "fe80::2%wg0".
+	Client string
+
+	// IPs specify the IP addresses assigned to the client.
+	IPs []*net.IPNet
+
+	// LeaseStart specifies the time that the lease began.
+	LeaseStart time.Time
+
+	// LeaseTime specifies the duration of the lease.
+	LeaseTime time.Duration
+}
+
+// newLease creates a Lease for the client at src from a server's RequestIP
+// response. If the response does not specify a lease start time, the lease
+// begins now.
+func newLease(src net.Addr, rip *RequestIP) *Lease {
+	start := rip.LeaseStart
+	if start.IsZero() {
+		start = time.Now()
+	}
+
+	return &Lease{
+		Client:     clientKey(src),
+		IPs:        cloneIPNets(rip.IPs),
+		LeaseStart: start,
+		LeaseTime:  rip.LeaseTime,
+	}
+}
+
+// Expires returns the time at which the lease expires.
+func (l *Lease) Expires() time.Time {
+	return l.LeaseStart.Add(l.LeaseTime)
+}
+
+// Expired reports whether the lease has expired as of time t.
+func (l *Lease) Expired(t time.Time) bool {
+	return !t.Before(l.Expires())
+}
@@ -0,0 +1,375 @@
+package wgdynamic
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A LeaseManager tracks the leases granted by an IP address allocator and
+// reclaims their addresses once the leases expire. LeaseManager.RequestIP can
+// be used as the RequestIP function for a Server, and LeaseManager.Run must
+// be called to process lease expiry.
+//
+// Each callback is invoked synchronously and without any internal locks held.
+// Callbacks are invoked one at a time, in the order in which the leases
+// changed, so OnExpire for a client's previous lease is never invoked after
+// OnGrant or OnRenew for its next lease. Callbacks may call Leases, but must
+// not call RequestIP, Add, or Remove. OnGrant and OnRenew are invoked before
+// the response is sent to the client.
+type LeaseManager struct {
+	// Allocate handles IP address assignment for each request, such as
+	// Pool.RequestIP. It must not be nil.
+	Allocate func(src net.Addr, r *RequestIP) (*RequestIP, error)
+
+	// Reclaim is called with each lease which expires so its addresses can
+	// be returned to the allocator, such as Pool.ReleaseLease or
+	// InterfacePolicies.ReleaseLease. If nil, addresses are not reclaimed.
+	Reclaim func(l *Lease)
+
+	// OnGrant is called when a lease is granted to a client which did not
+	// hold a lease. If nil, no action is taken.
+	OnGrant func(l *Lease)
+
+	// OnRenew is called when a client which holds a lease is assigned the
+	// same addresses again. If nil, no action is taken.
+	OnRenew func(l *Lease)
+
+	// OnExpire is called when a lease expires or is removed. If nil, no
+	// action is taken.
+	OnExpire func(l *Lease)
+
+	mu      sync.Mutex
+	leases  leaseHeap
+	clients map[string]*leaseItem
+	wakeC   chan struct{}
+
+	// last is closed when the most recently enqueued callbacks have returned.
+	last chan struct{}
+}
+
+// RequestIP allocates IP addresses using m.Allocate and tracks the resulting
+// lease. It implements the signature of Server.RequestIP.
+//
+// If a client which holds a lease is assigned different addresses, the
+// previous lease is treated as expired, but its addresses are not passed to
+// Reclaim because the allocator has already replaced them.
+//
+// If Allocate does not set LeaseStart, the lease begins when Allocate returns.
+// If Allocate does not set a positive LeaseTime, RequestIP returns an error
+// and passes any newly allocated addresses to Reclaim.
+func (m *LeaseManager) RequestIP(src net.Addr, r *RequestIP) (*RequestIP, error) {
+	if m.Allocate == nil {
+		return nil, errors.New("wgdynamic: LeaseManager.Allocate must not be nil")
+	}
+
+	// Hold the lock across allocation so that an expiring lease cannot be
+	// reclaimed while it is being renewed.
+	m.mu.Lock()
+	res, err := m.Allocate(src, r)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+
+	l := newLease(src, res)
+	if l.LeaseTime <= 0 {
+		m.reject(l)
+		m.mu.Unlock()
+		return nil, fmt.Errorf("wgdynamic: LeaseManager.Allocate returned invalid lease time %s", l.LeaseTime)
+	}
+
+	notify := m.enqueue(m.track(l))
+	m.mu.Unlock()
+
+	notify()
+	return res, nil
+}
+
+// Add begins tracking l, such as a lease restored from a LeaseStore. The
+// appropriate callbacks are invoked as if l had been granted by RequestIP.
+func (m *LeaseManager) Add(l *Lease) {
+	m.mu.Lock()
+	notify := m.enqueue(m.track(cloneLease(l)))
+	m.mu.Unlock()
+
+	notify()
+}
+
+// Remove ends the lease held by client before it expires. The lease's addresses
+// are reclaimed and OnExpire is invoked. Remove reports whether client held
+// a lease.
+func (m *LeaseManager) Remove(client string) bool {
+	m.mu.Lock()
+	li, ok := m.clients[client]
+	if !ok {
+		m.mu.Unlock()
+		return false
+	}
+
+	m.untrack(li)
+	m.reclaim(li.l)
+	notify := m.enqueue([]leaseEvent{{fn: m.OnExpire, l: li.l}})
+	m.mu.Unlock()
+
+	notify()
+	return true
+}
+
+// Leases returns all of the leases tracked by m, sorted by expiry time.
+func (m *LeaseManager) Leases() []*Lease {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ls := make([]*Lease, 0, len(m.leases))
+	for _, li := range m.leases {
+		ls = append(ls, cloneLease(li.l))
+	}
+
+	sort.SliceStable(ls, func(i, j int) bool {
+		return ls[i].Expires().Before(ls[j].Expires())
+	})
+
+	return ls
+}
+
+// Run processes lease expiry until ctx is canceled. Run returns the error
+// from ctx when it is canceled.
+func (m *LeaseManager) Run(ctx context.Context) error {
+	m.mu.Lock()
+	m.init()
+	wakeC := m.wakeC
+	m.mu.Unlock()
+
+	for {
+		next, ok := m.expire(time.Now())
+
+		// Wait until the next lease expires, a new lease is added, or the
+		// context is canceled.
+		var (
+			timer  *time.Timer
+			timerC <-chan time.Time
+		)
+		if ok {
+			timer = time.NewTimer(time.Until(next))
+			timerC = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return ctx.Err()
+		case <-timerC:
+		case <-wakeC:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// expire expires all leases as of time now, and returns the expiry time of the
+// next lease, if any.
+func (m *LeaseManager) expire(now time.Time) (time.Time, bool) {
+	var events []leaseEvent
+
+	m.mu.Lock()
+	for len(m.leases) > 0 && m.leases[0].l.Expired(now) {
+		li := m.leases[0]
+		m.untrack(li)
+		m.reclaim(li.l)
+
+		events = append(events, leaseEvent{fn: m.OnExpire, l: li.l})
+	}
+
+	var (
+		next time.Time
+		ok   bool
+	)
+	if len(m.leases) > 0 {
+		next, ok = m.leases[0].l.Expires(), true
+	}
+	notify := m.enqueue(events)
+	m.mu.Unlock()
+
+	notify()
+	return next, ok
+}
+
+// track begins tracking l and returns the callbacks which should be invoked
+// as a result. m.mu must be held when calling track.
+func (m *LeaseManager) track(l *Lease) []leaseEvent {
+	m.init()
+
+	var events []leaseEvent
+	if li, ok := m.clients[l.Client]; ok {
+		m.untrack(li)
+
+		if equalIPNets(li.l.IPs, l.IPs) {
+			events = append(events, leaseEvent{fn: m.OnRenew, l: l})
+		} else {
+			events = append(events,
+				leaseEvent{fn: m.OnExpire, l: li.l},
+				leaseEvent{fn: m.OnGrant, l: l},
+			)
+		}
+	} else {
+		events = append(events, leaseEvent{fn: m.OnGrant, l: l})
+	}
+
+	li := &leaseItem{l: l}
+	heap.Push(&m.leases, li)
+	m.clients[l.Client] = li
+
+	// Wake the expiry loop so it can account for the new lease.
+	select {
+	case m.wakeC <- struct{}{}:
+	default:
+	}
+
+	return events
+}
+
+// reject reclaims any addresses in l which are not held by its client's
+// current lease. m.mu must be held when calling reject.
+func (m *LeaseManager) reject(l *Lease) {
+	var held []*net.IPNet
+	if li, ok := m.clients[l.Client]; ok {
+		held = li.l.IPs
+	}
+
+	var ips []*net.IPNet
+next:
+	for _, ip := range l.IPs {
+		for _, h := range held {
+			if h.String() == ip.String() {
+				continue next
+			}
+		}
+
+		ips = append(ips, ip)
+	}
+
+	m.reclaim(&Lease{Client: l.Client, IPs: ips})
+}
+
+// untrack stops tracking li. m.mu must be held when calling untrack.
+func (m *LeaseManager) untrack(li *leaseItem) {
+	heap.Remove(&m.leases, li.index)
+	delete(m.clients, li.l.Client)
+}
+
+// reclaim returns the addresses of l to the allocator. m.mu must be held when
+// calling reclaim.
+func (m *LeaseManager) reclaim(l *Lease) {
+	if m.Reclaim != nil && len(l.IPs) > 0 {
+		m.Reclaim(cloneLease(l))
+	}
+}
+
+// init initializes internal state. m.mu must be held when calling init.
+func (m *LeaseManager) init() {
+	if m.clients != nil {
+		return
+	}
+
+	m.clients = make(map[string]*leaseItem)
+	m.wakeC = make(chan struct{}, 1)
+}
+
+// enqueue reserves the next position in the order of callback invocation for
+// events, and returns a function which invokes them once all previously
+// enqueued callbacks have returned. m.mu must be held when calling enqueue.
+func (m *LeaseManager) enqueue(events []leaseEvent) func() {
+	if len(events) == 0 {
+		return func() {}
+	}
+
+	prev, done := m.last, make(chan struct{})
+	m.last = done
+
+	return func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+
+		m.notify(events)
+	}
+}
+
+// notify invokes the callbacks for events, skipping any which are nil.
+func (m *LeaseManager) notify(events []leaseEvent) {
+	for _, e := range events {
+		if e.fn != nil {
+			e.fn(cloneLease(e.l))
+		}
+	}
+}
+
+// A leaseEvent is a callback which should be invoked for a lease.
+type leaseEvent struct {
+	fn func(l *Lease)
+	l  *Lease
+}
+
+// A leaseItem is a Lease stored in a leaseHeap.
+type leaseItem struct {
+	l     *Lease
+	index int
+}
+
+var _ heap.Interface = &leaseHeap{}
+
+// A leaseHeap is a min-heap of leases ordered by expiry time.
+type leaseHeap []*leaseItem
+
+func (h leaseHeap) Len() int { return len(h) }
+
+func (h leaseHeap) Less(i, j int) bool {
+	return h[i].l.Expires().Before(h[j].l.Expires())
+}
+
+func (h leaseHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *leaseHeap) Push(x interface{}) {
+	li := x.(*leaseItem)
+	li.index = len(*h)
+	*h = append(*h, li)
+}
+
+func (h *leaseHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	li := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return li
+}
+
+// equalIPNets reports whether a and b contain the same addresses in the same
+// order.
+func equalIPNets(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,305 @@
+package wgdynamic_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestLeaseManagerRequestIP(t *testing.T) {
+	p, err := wgdynamic.NewPool(mustCIDR("192.0.2.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+
+	record := func(event string) func(l *wgdynamic.Lease) {
+		return func(l *wgdynamic.Lease) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event+" "+l.Client+" "+l.IPs[0].String())
+		}
+	}
+
+	m := &wgdynamic.LeaseManager{
+		Allocate: p.RequestIP,
+		Reclaim:  p.ReleaseLease,
+		OnGrant:  record("grant"),
+		OnRenew:  record("renew"),
+		OnExpire: record("expire"),
+	}
+
+	src := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "wg0"}
+
+	// Grant and renew the same addresses, then request different addresses.
+	for _, r := range []*wgdynamic.RequestIP{
+		nil,
+		nil,
+		{IPs: []*net.IPNet{mustIPNet("192.0.2.10/32")}},
+	} {
+		if _, err := m.RequestIP(src, r); err != nil {
+			t.Fatalf("failed to request IP: %v", err)
+		}
+	}
+
+	if !m.Remove("fe80::1%wg0") {
+		t.Fatal("expected lease to be removed")
+	}
+	if m.Remove("fe80::1%wg0") {
+		t.Fatal("expected no lease to be removed")
+	}
+
+	want := []string{
+		"grant fe80::1%wg0 192.0.2.1/32",
+		"renew fe80::1%wg0 192.0.2.1/32",
+		"expire fe80::1%wg0 192.0.2.1/32",
+		"grant fe80::1%wg0 192.0.2.10/32",
+		"expire fe80::1%wg0 192.0.2.10/32",
+	}
+
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Fatalf("unexpected events (-want +got):\n%s", diff)
+	}
+}
+
+func TestLeaseManagerCallbackOrder(t *testing.T) {
+	p, err := wgdynamic.NewPool(mustCIDR("192.0.2.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	var (
+		mu     sync.Mutex
+		events []string
+
+		grantC   = make(chan struct{})
+		releaseC = make(chan struct{})
+	)
+
+	m := &wgdynamic.LeaseManager{
+		Allocate: p.RequestIP,
+		Reclaim:  p.ReleaseLease,
+		OnGrant: func(_ *wgdynamic.Lease) {
+			// Block the grant callback until the lease has been removed.
+			close(grantC)
+			<-releaseC
+
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, "grant")
+		},
+		OnExpire: func(_ *wgdynamic.Lease) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, "expire")
+		},
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	defer wg.Wait()
+
+	go func() {
+		defer wg.Done()
+
+		src := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "wg0"}
+		if _, err := m.RequestIP(src, nil); err != nil {
+			panicf("failed to request IP: %v", err)
+		}
+	}()
+
+	<-grantC
+
+	removedC := make(chan bool)
+	go func() {
+		defer wg.Done()
+		removedC <- m.Remove("fe80::1%wg0")
+	}()
+
+	// Give the expire callback an opportunity to run out of order before
+	// allowing the grant callback to complete.
+	time.Sleep(50 * time.Millisecond)
+	close(releaseC)
+
+	if !<-removedC {
+		t.Fatal("expected lease to be removed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if diff := cmp.Diff([]string{"grant", "expire"}, events); diff != "" {
+		t.Fatalf("unexpected events (-want +got):\n%s", diff)
+	}
+}
+
+func TestLeaseManagerRunExpire(t *testing.T) {
+	p, err := wgdynamic.NewPool(mustCIDR("192.0.2.0/30"))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	expireC := make(chan *wgdynamic.Lease, 1)
+	m := &wgdynamic.LeaseManager{
+		Allocate: p.RequestIP,
+		Reclaim:  p.ReleaseLease,
+		OnExpire: func(l *wgdynamic.Lease) {
+			expireC <- l
+		},
+	}
+
+	var (
+		expired = &wgdynamic.Lease{
+			Client:     "fe80::1%wg0",
+			IPs:        []*net.IPNet{mustIPNet("192.0.2.1/32")},
+			LeaseStart: time.Now().Add(-1 * time.Hour),
+			LeaseTime:  1 * time.Second,
+		}
+		active = &wgdynamic.Lease{
+			Client:     "fe80::2%wg0",
+			IPs:        []*net.IPNet{mustIPNet("192.0.2.2/32")},
+			LeaseStart: time.Now(),
+			LeaseTime:  1 * time.Hour,
+		}
+	)
+
+	// Both addresses in the pool are leased.
+	for _, l := range []*wgdynamic.Lease{expired, active} {
+		if err := p.Restore(l); err != nil {
+			t.Fatalf("failed to restore lease: %v", err)
+		}
+		m.Add(l)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	go func() {
+		defer wg.Done()
+		if err := m.Run(ctx); err != context.Canceled {
+			panicf("failed to run: %v", err)
+		}
+	}()
+
+	if diff := cmp.Diff(expired, <-expireC); diff != "" {
+		t.Fatalf("unexpected expired lease (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]*wgdynamic.Lease{active}, m.Leases()); diff != "" {
+		t.Fatalf("unexpected leases (-want +got):\n%s", diff)
+	}
+
+	// The expired lease's address is now available to a new client.
+	res, err := m.RequestIP(&net.TCPAddr{IP: net.ParseIP("fe80::3"), Zone: "wg0"}, nil)
+	if err != nil {
+		t.Fatalf("failed to request IP: %v", err)
+	}
+
+	if diff := cmp.Diff(expired.IPs, res.IPs); diff != "" {
+		t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+	}
+}
+
+func TestLeaseManagerZeroLeaseStart(t *testing.T) {
+	expireC := make(chan *wgdynamic.Lease, 1)
+	m := &wgdynamic.LeaseManager{
+		// An allocator which does not set LeaseStart.
+		Allocate: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			return &wgdynamic.RequestIP{
+				IPs:       []*net.IPNet{mustIPNet("192.0.2.1/32")},
+				LeaseTime: 1 * time.Hour,
+			}, nil
+		},
+		OnExpire: func(l *wgdynamic.Lease) {
+			expireC <- l
+		},
+	}
+
+	before := time.Now()
+	if _, err := m.RequestIP(&net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "wg0"}, nil); err != nil {
+		t.Fatalf("failed to request IP: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := m.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("failed to run: %v", err)
+	}
+
+	select {
+	case l := <-expireC:
+		t.Fatalf("lease expired immediately: %+v", l)
+	default:
+	}
+
+	// The lease begins when it is granted.
+	ls := m.Leases()
+	if len(ls) != 1 {
+		t.Fatalf("expected 1 lease, but got %d", len(ls))
+	}
+	if ls[0].LeaseStart.Before(before) || ls[0].LeaseStart.After(time.Now()) {
+		t.Fatalf("unexpected lease start: %v", ls[0].LeaseStart)
+	}
+}
+
+func TestLeaseManagerInvalidLeaseTime(t *testing.T) {
+	p, err := wgdynamic.NewPool(mustCIDR("192.0.2.0/30"))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	var grants int
+	m := &wgdynamic.LeaseManager{
+		// An allocator which does not set a lease time.
+		Allocate: func(src net.Addr, r *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			res, err := p.RequestIP(src, r)
+			if err != nil {
+				return nil, err
+			}
+
+			res.LeaseTime = 0
+			return res, nil
+		},
+		Reclaim: p.ReleaseLease,
+		OnGrant: func(_ *wgdynamic.Lease) {
+			grants++
+		},
+	}
+
+	if _, err := m.RequestIP(&net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "wg0"}, nil); err == nil {
+		t.Fatal("expected an error, but none occurred")
+	}
+
+	if grants != 0 {
+		t.Fatalf("expected no grants, but got %d", grants)
+	}
+	if diff := cmp.Diff([]*wgdynamic.Lease{}, m.Leases()); diff != "" {
+		t.Fatalf("unexpected leases (-want +got):\n%s", diff)
+	}
+
+	// The rejected address was reclaimed and is available to a new client.
+	res, err := p.RequestIP(&net.TCPAddr{IP: net.ParseIP("fe80::2"), Zone: "wg0"}, nil)
+	if err != nil {
+		t.Fatalf("failed to request IP: %v", err)
+	}
+
+	if diff := cmp.Diff([]*net.IPNet{mustIPNet("192.0.2.1/32")}, res.IPs); diff != "" {
+		t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,444 @@
+package wgdynamic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultCompactAfter is the number of journal entries which may be appended
+// to a LeaseStore before it is automatically compacted.
+const defaultCompactAfter = 1024
+
+// A LeaseStore is a file-backed database of client leases. Leases are stored
+// in an append-only journal which is periodically compacted into a snapshot of
+// the current leases, so that leases survive a restart of the server.
+//
+// Each change is synced to disk before it is acknowledged. If the process
+// crashes while writing an entry, the incomplete entry is discarded when the
+// LeaseStore is next opened.
+type LeaseStore struct {
+	// CompactAfter specifies the number of journal entries which may be
+	// appended to the LeaseStore before it is automatically compacted. If
+	// zero, a default value is used. If negative, automatic compaction is
+	// disabled.
+	CompactAfter int
+
+	// Log specifies an error logger for the LeaseStore, which is used to
+	// report failed automatic compactions. If nil, all error logs are
+	// discarded.
+	Log *log.Logger
+
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	leases  map[string]*Lease
+	entries int
+}
+
+// OpenLeaseStore opens or creates a LeaseStore at the specified path and loads
+// any existing leases.
+func OpenLeaseStore(path string) (*LeaseStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &LeaseStore{
+		path:   path,
+		f:      f,
+		leases: make(map[string]*Lease),
+	}
+
+	if err := s.load(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the LeaseStore's underlying file.
+func (s *LeaseStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
+
+// Leases returns all of the leases in the LeaseStore, sorted by client.
+func (s *LeaseStore) Leases() []*Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ls := make([]*Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		ls = append(ls, cloneLease(l))
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Client < ls[j].Client
+	})
+
+	return ls
+}
+
+// Lease returns the lease for client, if one exists.
+func (s *LeaseStore) Lease(client string) (*Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.leases[client]
+	if !ok {
+		return nil, false
+	}
+
+	return cloneLease(l), true
+}
+
+// Put stores l, replacing any existing lease for the same client. Put only
+// returns an error if l could not be stored; a failed automatic compaction is
+// reported to Log instead.
+func (s *LeaseStore) Put(l *Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Store the lease in memory exactly as it would be loaded from disk.
+	jl := toJSONLease(l)
+	stored, err := jl.toLease()
+	if err != nil {
+		return err
+	}
+
+	if err := s.append(journalEntry{Op: opPut, Lease: jl}); err != nil {
+		return err
+	}
+
+	s.leases[l.Client] = stored
+	s.maybeCompact()
+	return nil
+}
+
+// Delete removes the lease for client. Deleting a lease which does not exist
+// is a no-op.
+func (s *LeaseStore) Delete(client string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.leases[client]; !ok {
+		return nil
+	}
+
+	if err := s.append(journalEntry{Op: opDelete, Client: client}); err != nil {
+		return err
+	}
+
+	delete(s.leases, client)
+	s.maybeCompact()
+	return nil
+}
+
+// Compact replaces the journal with a snapshot of the current leases.
+func (s *LeaseStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.compact()
+}
+
+// RequestIP wraps fn so that each successful IP address assignment is stored
+// in the LeaseStore. The returned function can be used as the RequestIP
+// function for a Server. If a lease cannot be stored, an error is returned
+// to the client.
+func (s *LeaseStore) RequestIP(
+	fn func(src net.Addr, r *RequestIP) (*RequestIP, error),
+) func(src net.Addr, r *RequestIP) (*RequestIP, error) {
+	return func(src net.Addr, r *RequestIP) (*RequestIP, error) {
+		res, err := fn(src, r)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.Put(newLease(src, res)); err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	}
+}
+
+// load replays the journal to populate s.leases. If the final journal entry
+// is incomplete, it is truncated from the file.
+func (s *LeaseStore) load() error {
+	var (
+		br     = bufio.NewReader(s.f)
+		offset int64
+	)
+
+	for {
+		b, err := br.ReadBytes('\n')
+		switch {
+		case err == io.EOF:
+			// Any trailing bytes without a newline are an incomplete entry,
+			// so discard them and prepare to append after the last complete
+			// entry.
+			if len(b) > 0 {
+				if err := s.f.Truncate(offset); err != nil {
+					return err
+				}
+			}
+
+			_, err := s.f.Seek(offset, io.SeekStart)
+			return err
+		case err != nil:
+			return err
+		}
+
+		var e journalEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return fmt.Errorf("wgdynamic: corrupt lease journal entry at offset %d: %v", offset, err)
+		}
+
+		if err := s.apply(e); err != nil {
+			return fmt.Errorf("wgdynamic: invalid lease journal entry at offset %d: %v", offset, err)
+		}
+
+		offset += int64(len(b))
+		s.entries++
+	}
+}
+
+// apply applies a journal entry to s.leases.
+func (s *LeaseStore) apply(e journalEntry) error {
+	switch e.Op {
+	case opPut:
+		if e.Lease == nil {
+			return errors.New("missing lease")
+		}
+
+		l, err := e.Lease.toLease()
+		if err != nil {
+			return err
+		}
+
+		s.leases[l.Client] = l
+	case opDelete:
+		delete(s.leases, e.Client)
+	default:
+		return fmt.Errorf("unknown operation %q", e.Op)
+	}
+
+	return nil
+}
+
+// append writes a journal entry and syncs it to disk. s.mu must be held when
+// calling append.
+func (s *LeaseStore) append(e journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	off, err := s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// Attempt to remove any partially written or unsynced entry so that
+	// later entries are not appended to it, and so the journal does not
+	// contain a change which was not applied in memory.
+	undo := func() {
+		_ = s.f.Truncate(off)
+		_, _ = s.f.Seek(off, io.SeekStart)
+	}
+
+	if _, err := s.f.Write(append(b, '\n')); err != nil {
+		undo()
+		return err
+	}
+
+	if err := s.f.Sync(); err != nil {
+		undo()
+		return err
+	}
+
+	s.entries++
+	return nil
+}
+
+// maybeCompact compacts the journal once it has grown large enough. The change
+// which grew the journal has already been persisted, so a failed compaction
+// is logged rather than returned, and is retried after the next change. s.mu
+// must be held when calling maybeCompact.
+func (s *LeaseStore) maybeCompact() {
+	n := s.CompactAfter
+	switch {
+	case n < 0:
+		return
+	case n == 0:
+		n = defaultCompactAfter
+	}
+
+	// Only compact once the journal has grown beyond both the threshold and
+	// the size of a snapshot, so that a large number of leases does not cause
+	// compaction on every change.
+	if s.entries < n || s.entries < 2*len(s.leases) {
+		return
+	}
+
+	if err := s.compact(); err != nil {
+		s.logf("failed to compact lease journal %q: %v", s.path, err)
+	}
+}
+
+// compact writes a snapshot of s.leases to a temporary file and atomically
+// replaces the journal with it. s.mu must be held when calling compact.
+func (s *LeaseStore) compact() error {
+	clients := make([]string, 0, len(s.leases))
+	for c := range s.leases {
+		clients = append(clients, c)
+	}
+	sort.Strings(clients)
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, c := range clients {
+		if err := enc.Encode(journalEntry{Op: opPut, Lease: toJSONLease(s.leases[c])}); err != nil {
+			return err
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the snapshot is fully persisted before it replaces the journal.
+	if _, err := b.WriteTo(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	// The snapshot is now the journal, so continue appending to it even if
+	// the rename cannot be persisted: the previous journal is unlinked and
+	// any further writes to it would be lost.
+	_ = s.f.Close()
+	s.f = f
+	s.entries = len(clients)
+
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir syncs a directory so that a rename within it is persisted.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Possible journal entry operations.
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// A journalEntry is a single entry in a LeaseStore journal.
+type journalEntry struct {
+	Op     string     `json:"op"`
+	Client string     `json:"client,omitempty"`
+	Lease  *jsonLease `json:"lease,omitempty"`
+}
+
+// A jsonLease is the JSON representation of a Lease. Times are stored in the
+// same units as the wg-dynamic protocol, and a zero LeaseStart is omitted.
+type jsonLease struct {
+	Client     string   `json:"client"`
+	IPs        []string `json:"ips,omitempty"`
+	LeaseStart int64    `json:"leasestart,omitempty"`
+	LeaseTime  int64    `json:"leasetime"`
+}
+
+// toJSONLease converts a Lease to its JSON representation.
+func toJSONLease(l *Lease) *jsonLease {
+	ips := make([]string, 0, len(l.IPs))
+	for _, ip := range l.IPs {
+		ips = append(ips, ip.String())
+	}
+
+	jl := &jsonLease{
+		Client:    l.Client,
+		IPs:       ips,
+		LeaseTime: int64(l.LeaseTime / time.Second),
+	}
+	if !l.LeaseStart.IsZero() {
+		jl.LeaseStart = l.LeaseStart.Unix()
+	}
+
+	return jl
+}
+
+// toLease converts a jsonLease to a Lease.
+func (jl *jsonLease) toLease() (*Lease, error) {
+	var ips []*net.IPNet
+	for _, s := range jl.IPs {
+		ipn, err := parseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+
+		ips = append(ips, ipn)
+	}
+
+	l := &Lease{
+		Client:    jl.Client,
+		IPs:       ips,
+		LeaseTime: time.Duration(jl.LeaseTime) * time.Second,
+	}
+	if jl.LeaseStart != 0 {
+		l.LeaseStart = time.Unix(jl.LeaseStart, 0)
+	}
+
+	return l, nil
+}
+
+// cloneLease produces a deep copy of l.
+func cloneLease(l *Lease) *Lease {
+	return &Lease{
+		Client:     l.Client,
+		IPs:        cloneIPNets(l.IPs),
+		LeaseStart: l.LeaseStart,
+		LeaseTime:  l.LeaseTime,
+	}
+}
+
+// logf logs a formatted message if s.Log is set.
+func (s *LeaseStore) logf(format string, v ...interface{}) {
+	if s.Log == nil {
+		return
+	}
+
+	s.Log.Printf(format, v...)
+}
@@ -0,0 +1,241 @@
+package wgdynamic_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestLeaseStore(t *testing.T) {
+	var (
+		l1 = &wgdynamic.Lease{
+			Client:     "fe80::1%wg0",
+			IPs:        []*net.IPNet{mustIPNet("192.0.2.1/32"), mustIPNet("2001:db8::1/128")},
+			LeaseStart: time.Unix(1, 0),
+			LeaseTime:  10 * time.Second,
+		}
+		l2 = &wgdynamic.Lease{
+			Client:     "fe80::2%wg0",
+			IPs:        []*net.IPNet{mustIPNet("192.0.2.2/32")},
+			LeaseStart: time.Unix(2, 0),
+			LeaseTime:  20 * time.Second,
+		}
+	)
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s *wgdynamic.LeaseStore)
+		want []*wgdynamic.Lease
+	}{
+		{
+			name: "empty",
+			fn:   func(_ *testing.T, _ *wgdynamic.LeaseStore) {},
+			want: []*wgdynamic.Lease{},
+		},
+		{
+			name: "put",
+			fn: func(t *testing.T, s *wgdynamic.LeaseStore) {
+				mustPut(t, s, l2)
+				mustPut(t, s, l1)
+			},
+			want: []*wgdynamic.Lease{l1, l2},
+		},
+		{
+			name: "put replace and delete",
+			fn: func(t *testing.T, s *wgdynamic.LeaseStore) {
+				mustPut(t, s, l1)
+				mustPut(t, s, l2)
+				mustPut(t, s, &wgdynamic.Lease{Client: l1.Client})
+
+				if err := s.Delete(l2.Client); err != nil {
+					t.Fatalf("failed to delete: %v", err)
+				}
+			},
+			want: []*wgdynamic.Lease{{
+				Client: l1.Client,
+			}},
+		},
+		{
+			name: "compact",
+			fn: func(t *testing.T, s *wgdynamic.LeaseStore) {
+				for i := 0; i < 10; i++ {
+					mustPut(t, s, l1)
+				}
+				mustPut(t, s, l2)
+
+				if err := s.Compact(); err != nil {
+					t.Fatalf("failed to compact: %v", err)
+				}
+
+				// Modifications after compaction must also persist.
+				if err := s.Delete(l2.Client); err != nil {
+					t.Fatalf("failed to delete: %v", err)
+				}
+			},
+			want: []*wgdynamic.Lease{l1},
+		},
+		{
+			name: "automatic compaction",
+			fn: func(t *testing.T, s *wgdynamic.LeaseStore) {
+				s.CompactAfter = 2
+				for i := 0; i < 10; i++ {
+					mustPut(t, s, l1)
+					mustPut(t, s, l2)
+				}
+			},
+			want: []*wgdynamic.Lease{l1, l2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, done := testLeaseStorePath(t)
+			defer done()
+
+			s, err := wgdynamic.OpenLeaseStore(path)
+			if err != nil {
+				t.Fatalf("failed to open lease store: %v", err)
+			}
+
+			tt.fn(t, s)
+
+			if diff := cmp.Diff(tt.want, s.Leases()); diff != "" {
+				t.Fatalf("unexpected leases (-want +got):\n%s", diff)
+			}
+
+			if err := s.Close(); err != nil {
+				t.Fatalf("failed to close lease store: %v", err)
+			}
+
+			// Reopen the store and verify the same leases are loaded from
+			// disk.
+			s, err = wgdynamic.OpenLeaseStore(path)
+			if err != nil {
+				t.Fatalf("failed to reopen lease store: %v", err)
+			}
+			defer s.Close()
+
+			if diff := cmp.Diff(tt.want, s.Leases()); diff != "" {
+				t.Fatalf("unexpected reloaded leases (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLeaseStoreIncompleteEntry(t *testing.T) {
+	path, done := testLeaseStorePath(t)
+	defer done()
+
+	l := &wgdynamic.Lease{
+		Client:     "fe80::1%wg0",
+		IPs:        []*net.IPNet{mustIPNet("192.0.2.1/32")},
+		LeaseStart: time.Unix(1, 0),
+		LeaseTime:  10 * time.Second,
+	}
+
+	s, err := wgdynamic.OpenLeaseStore(path)
+	if err != nil {
+		t.Fatalf("failed to open lease store: %v", err)
+	}
+	mustPut(t, s, l)
+	_ = s.Close()
+
+	// Simulate a crash while writing an entry.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	if _, err := f.WriteString(`{"op":"put","lease":{"cli`); err != nil {
+		t.Fatalf("failed to write journal: %v", err)
+	}
+	_ = f.Close()
+
+	s, err = wgdynamic.OpenLeaseStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen lease store: %v", err)
+	}
+	defer s.Close()
+
+	// The incomplete entry is discarded and new entries can be appended.
+	if err := s.Delete(l.Client); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	if diff := cmp.Diff([]*wgdynamic.Lease{}, s.Leases()); diff != "" {
+		t.Fatalf("unexpected leases (-want +got):\n%s", diff)
+	}
+}
+
+func TestLeaseStoreCompactFailure(t *testing.T) {
+	path, done := testLeaseStorePath(t)
+	defer done()
+
+	// Prevent compaction by occupying the path of its temporary file.
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	s, err := wgdynamic.OpenLeaseStore(path)
+	if err != nil {
+		t.Fatalf("failed to open lease store: %v", err)
+	}
+	defer s.Close()
+
+	var lb bytes.Buffer
+	s.CompactAfter = 1
+	s.Log = log.New(&lb, "", 0)
+
+	l := &wgdynamic.Lease{
+		Client:     "fe80::1%wg0",
+		IPs:        []*net.IPNet{mustIPNet("192.0.2.1/32")},
+		LeaseStart: time.Unix(1, 0),
+		LeaseTime:  10 * time.Second,
+	}
+
+	// The lease is stored even though the following compaction fails.
+	for i := 0; i < 3; i++ {
+		mustPut(t, s, l)
+	}
+
+	if err := s.Compact(); err == nil {
+		t.Fatal("expected a compaction error, but none occurred")
+	}
+
+	if diff := cmp.Diff([]*wgdynamic.Lease{l}, s.Leases()); diff != "" {
+		t.Fatalf("unexpected leases (-want +got):\n%s", diff)
+	}
+
+	if !strings.Contains(lb.String(), "failed to compact lease journal") {
+		t.Fatalf("unexpected log output: %q", lb.String())
+	}
+}
+
+func mustPut(t *testing.T, s *wgdynamic.LeaseStore, l *wgdynamic.Lease) {
+	t.Helper()
+
+	if err := s.Put(l); err != nil {
+		t.Fatalf("failed to put lease: %v", err)
+	}
+}
+
+func testLeaseStorePath(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "wgdynamic-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+
+	return filepath.Join(dir, "leases"), func() {
+		_ = os.RemoveAll(dir)
+	}
+}
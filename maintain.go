@@ -0,0 +1,283 @@
+package wgdynamic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Default parameters for Client.Maintain.
+const (
+	defaultT1             = 0.5
+	defaultT2             = 0.875
+	defaultMinBackoff     = 1 * time.Second
+	defaultMaxBackoff     = 1 * time.Minute
+	defaultRequestTimeout = 30 * time.Second
+)
+
+// A LeaseEventType indicates the type of a LeaseEvent.
+type LeaseEventType int
+
+// Possible LeaseEventType values.
+const (
+	_ LeaseEventType = iota
+
+	// LeaseAcquired indicates that a lease was acquired by a client which did
+	// not hold a lease.
+	LeaseAcquired
+
+	// LeaseRenewed indicates that a lease was renewed with the same
+	// addresses.
+	LeaseRenewed
+
+	// LeaseLost indicates that a lease expired before it could be renewed, or
+	// that the server assigned different addresses on renewal.
+	LeaseLost
+)
+
+// String implements fmt.Stringer.
+func (t LeaseEventType) String() string {
+	switch t {
+	case LeaseAcquired:
+		return "acquired"
+	case LeaseRenewed:
+		return "renewed"
+	case LeaseLost:
+		return "lost"
+	default:
+		return fmt.Sprintf("LeaseEventType(%d)", int(t))
+	}
+}
+
+// A LeaseEvent describes a change in the state of a lease maintained by
+// Client.Maintain.
+type LeaseEvent struct {
+	// Type specifies the type of LeaseEvent.
+	Type LeaseEventType
+
+	// Lease specifies the lease which was acquired, renewed, or lost. Its
+	// LeaseStart is the local time at which the request which produced the
+	// lease was sent, so Lease.Expires is not affected by any difference
+	// between the client and server clocks. Its Client field is not set.
+	Lease *Lease
+
+	// Err specifies the most recent error which prevented renewal of a lost
+	// lease, if any.
+	Err error
+}
+
+// MaintainConfig configures the lease renewal behavior of Client.Maintain.
+// Zero values indicate that the default should be used.
+type MaintainConfig struct {
+	// T1 specifies the fraction of a lease's duration after which the client
+	// attempts to renew the lease by requesting the same addresses. If zero,
+	// 0.5 is used.
+	T1 float64
+
+	// T2 specifies the fraction of a lease's duration after which the client
+	// stops requesting the same addresses and instead sends its original
+	// request, accepting any assignment the server offers. T2 must be greater
+	// than T1. If zero, 0.875 is used.
+	T2 float64
+
+	// MinBackoff and MaxBackoff specify the bounds of the exponential backoff
+	// applied between failed requests. Retries never wait beyond the expiry
+	// of a held lease. If zero, 1 second and 1 minute are used, respectively.
+	MinBackoff, MaxBackoff time.Duration
+
+	// RequestTimeout specifies the maximum duration of each request. A
+	// request made while a lease is held also times out when the lease
+	// expires, so an unresponsive server cannot delay the report of a lost
+	// lease. If zero, 30 seconds is used.
+	RequestTimeout time.Duration
+
+	// OnEvent is called synchronously for each LeaseEvent. If nil, no action
+	// is taken.
+	OnEvent func(e LeaseEvent)
+}
+
+// withDefaults returns a copy of cfg with any unset parameters populated with
+// their defaults, or an error if the parameters are invalid.
+func (cfg *MaintainConfig) withDefaults() (MaintainConfig, error) {
+	var c MaintainConfig
+	if cfg != nil {
+		c = *cfg
+	}
+
+	if c.T1 == 0 {
+		c.T1 = defaultT1
+	}
+	if c.T2 == 0 {
+		c.T2 = defaultT2
+	}
+	if c.MinBackoff == 0 {
+		c.MinBackoff = defaultMinBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = defaultRequestTimeout
+	}
+
+	if c.T1 <= 0 || c.T2 <= c.T1 || c.T2 >= 1 {
+		return MaintainConfig{}, fmt.Errorf("wgdynamic: T1 and T2 must satisfy 0 < T1 < T2 < 1: %v, %v", c.T1, c.T2)
+	}
+	if c.MinBackoff < 0 || c.MaxBackoff < c.MinBackoff {
+		return MaintainConfig{}, fmt.Errorf("wgdynamic: invalid backoff bounds: %s, %s", c.MinBackoff, c.MaxBackoff)
+	}
+	if c.RequestTimeout < 0 {
+		return MaintainConfig{}, fmt.Errorf("wgdynamic: invalid request timeout: %s", c.RequestTimeout)
+	}
+
+	return c, nil
+}
+
+// Maintain acquires a lease using req as described by RequestIP, and keeps the
+// lease renewed until ctx is canceled. Maintain returns the error from ctx
+// when it is canceled, or an error immediately if req or cfg are invalid. If
+// cfg is nil, the defaults described by MaintainConfig are used.
+//
+// Once T1 of a lease's duration has elapsed, Maintain attempts to renew the
+// lease by requesting the same addresses. Once T2 has elapsed, Maintain sends
+// req instead. Each request is bounded by RequestTimeout and the expiry of any
+// held lease, and failed requests are retried with exponential backoff. If the
+// lease expires before it can be renewed, a LeaseLost event is reported and
+// Maintain attempts to acquire a new lease.
+//
+// If a renewal assigns different addresses, a LeaseLost event for the previous
+// lease is followed by a LeaseAcquired event for the new lease.
+func (c *Client) Maintain(ctx context.Context, req *RequestIP, cfg *MaintainConfig) error {
+	mc, err := cfg.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	if req != nil && !req.LeaseStart.IsZero() {
+		return errors.New("wgdynamic: clients cannot specify a lease start time")
+	}
+
+	notify := func(typ LeaseEventType, l *Lease, err error) {
+		if mc.OnEvent != nil {
+			mc.OnEvent(LeaseEvent{
+				Type:  typ,
+				Lease: cloneLease(l),
+				Err:   err,
+			})
+		}
+	}
+
+	var (
+		lease   *Lease
+		backoff time.Duration
+		lastErr error
+	)
+
+	for {
+		if lease != nil && lease.Expired(time.Now()) {
+			notify(LeaseLost, lease, lastErr)
+			lease = nil
+		}
+
+		start := time.Now()
+		res, err := mc.requestIP(ctx, c, mc.request(req, lease, start), lease, start)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil && res.LeaseTime <= 0 {
+			err = errors.New("wgdynamic: server did not specify a lease time")
+		}
+
+		var wait time.Duration
+		if err != nil {
+			// Back off exponentially, but always wake up in time to report
+			// the expiry of a held lease.
+			lastErr = err
+			backoff = mc.next(backoff)
+			wait = backoff
+
+			if lease != nil {
+				if until := time.Until(lease.Expires()); until < wait {
+					wait = until
+				}
+			}
+		} else {
+			l := &Lease{
+				IPs:        cloneIPNets(res.IPs),
+				LeaseStart: start,
+				LeaseTime:  res.LeaseTime,
+			}
+
+			switch {
+			case lease == nil:
+				notify(LeaseAcquired, l, nil)
+			case equalIPNets(lease.IPs, l.IPs):
+				notify(LeaseRenewed, l, nil)
+			default:
+				notify(LeaseLost, lease, nil)
+				notify(LeaseAcquired, l, nil)
+			}
+
+			lease, backoff, lastErr = l, 0, nil
+			wait = time.Duration(float64(l.LeaseTime) * mc.T1)
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// request returns the request which should be sent at time now by a client
+// which holds lease, or which holds no lease if lease is nil.
+func (mc *MaintainConfig) request(req *RequestIP, lease *Lease, now time.Time) *RequestIP {
+	if lease == nil {
+		return req
+	}
+
+	t2 := time.Duration(float64(lease.LeaseTime) * mc.T2)
+	if !now.Before(lease.LeaseStart.Add(t2)) {
+		return req
+	}
+
+	// Renew the held lease by requesting its addresses.
+	r := &RequestIP{IPs: lease.IPs}
+	if req != nil {
+		r.LeaseTime = req.LeaseTime
+		r.Extensions = req.Extensions
+	}
+
+	return r
+}
+
+// requestIP sends req using c at time now, ensuring the request does not
+// outlive mc.RequestTimeout or the expiry of lease, if one is held.
+func (mc *MaintainConfig) requestIP(ctx context.Context, c *Client, req *RequestIP, lease *Lease, now time.Time) (*RequestIP, error) {
+	deadline := now.Add(mc.RequestTimeout)
+	if lease != nil && lease.Expires().Before(deadline) {
+		deadline = lease.Expires()
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	return c.RequestIP(ctx, req)
+}
+
+// next returns the backoff which follows backoff.
+func (mc *MaintainConfig) next(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < mc.MinBackoff {
+		backoff = mc.MinBackoff
+	}
+	if backoff > mc.MaxBackoff {
+		backoff = mc.MaxBackoff
+	}
+
+	return backoff
+}
@@ -0,0 +1,291 @@
+package wgdynamic_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestClientMaintain(t *testing.T) {
+	var (
+		ipA = mustIPNet("192.0.2.1/32")
+		ipB = mustIPNet("192.0.2.2/32")
+	)
+
+	tests := []struct {
+		name   string
+		res    func(n int) (*wgdynamic.RequestIP, error)
+		events []wgdynamic.LeaseEventType
+		ips    [][]*net.IPNet
+		err    error
+	}{
+		{
+			name: "renewed",
+			res: func(_ int) (*wgdynamic.RequestIP, error) {
+				return &wgdynamic.RequestIP{
+					IPs:       []*net.IPNet{ipA},
+					LeaseTime: 1 * time.Second,
+				}, nil
+			},
+			events: []wgdynamic.LeaseEventType{
+				wgdynamic.LeaseAcquired,
+				wgdynamic.LeaseRenewed,
+				wgdynamic.LeaseRenewed,
+			},
+			ips: [][]*net.IPNet{{ipA}, {ipA}, {ipA}},
+		},
+		{
+			name: "changed",
+			res: func(n int) (*wgdynamic.RequestIP, error) {
+				ip := ipA
+				if n > 0 {
+					ip = ipB
+				}
+
+				return &wgdynamic.RequestIP{
+					IPs:       []*net.IPNet{ip},
+					LeaseTime: 1 * time.Second,
+				}, nil
+			},
+			events: []wgdynamic.LeaseEventType{
+				wgdynamic.LeaseAcquired,
+				wgdynamic.LeaseLost,
+				wgdynamic.LeaseAcquired,
+			},
+			ips: [][]*net.IPNet{{ipA}, {ipA}, {ipB}},
+		},
+		{
+			name: "lost",
+			res: func(n int) (*wgdynamic.RequestIP, error) {
+				if n > 0 {
+					return nil, wgdynamic.ErrIPUnavailable
+				}
+
+				return &wgdynamic.RequestIP{
+					IPs:       []*net.IPNet{ipA},
+					LeaseTime: 1 * time.Second,
+				}, nil
+			},
+			events: []wgdynamic.LeaseEventType{
+				wgdynamic.LeaseAcquired,
+				wgdynamic.LeaseLost,
+			},
+			ips: [][]*net.IPNet{{ipA}, {ipA}},
+			err: wgdynamic.ErrIPUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu   sync.Mutex
+				n    int
+				reqs []*wgdynamic.RequestIP
+			)
+
+			c, done := testServer(t, &wgdynamic.Server{
+				RequestIP: func(_ net.Addr, r *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					reqs = append(reqs, r)
+					res, err := tt.res(n)
+					n++
+					return res, err
+				},
+			})
+			defer done()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			eventC := make(chan wgdynamic.LeaseEvent, len(tt.events))
+			cfg := &wgdynamic.MaintainConfig{
+				T1:         0.1,
+				T2:         0.2,
+				MinBackoff: 10 * time.Millisecond,
+				MaxBackoff: 50 * time.Millisecond,
+				OnEvent: func(e wgdynamic.LeaseEvent) {
+					// Stop once all of the expected events have occurred.
+					eventC <- e
+					if len(eventC) == cap(eventC) {
+						cancel()
+					}
+				},
+			}
+
+			if err := c.Maintain(ctx, nil, cfg); !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected context canceled error, but got: %v", err)
+			}
+			close(eventC)
+
+			var (
+				types []wgdynamic.LeaseEventType
+				ips   [][]*net.IPNet
+			)
+
+			for e := range eventC {
+				types = append(types, e.Type)
+				ips = append(ips, e.Lease.IPs)
+
+				if e.Lease.Expires().Before(time.Now().Add(-5 * time.Second)) {
+					t.Fatalf("lease expiry is not based on the local clock: %v", e.Lease.Expires())
+				}
+
+				if e.Type == wgdynamic.LeaseLost && !errors.Is(e.Err, tt.err) {
+					t.Fatalf("unexpected lost lease error: %v", e.Err)
+				}
+			}
+
+			if diff := cmp.Diff(tt.events, types); diff != "" {
+				t.Fatalf("unexpected events (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.ips, ips); diff != "" {
+				t.Fatalf("unexpected lease IPs (-want +got):\n%s", diff)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			// The initial request asks for any addresses and the first
+			// renewal asks for the leased addresses.
+			if len(reqs) < 2 {
+				t.Fatalf("expected at least 2 requests, but got %d", len(reqs))
+			}
+			if diff := cmp.Diff(&wgdynamic.RequestIP{}, reqs[0]); diff != "" {
+				t.Fatalf("unexpected initial request (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff([]*net.IPNet{ipA}, reqs[1].IPs); diff != "" {
+				t.Fatalf("unexpected renewal request IPs (-want +got):\n%s", diff)
+			}
+
+			if tt.err == nil {
+				return
+			}
+
+			// Once T2 elapses, renewals no longer ask for the leased
+			// addresses.
+			if diff := cmp.Diff(&wgdynamic.RequestIP{}, reqs[len(reqs)-1]); diff != "" {
+				t.Fatalf("unexpected final request (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClientMaintainServerHangs(t *testing.T) {
+	var (
+		mu sync.Mutex
+		n  int
+	)
+
+	c, done := testServer(t, &wgdynamic.Server{
+		RequestIPContext: func(ctx context.Context, _ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			mu.Lock()
+			first := n == 0
+			n++
+			mu.Unlock()
+
+			if first {
+				return &wgdynamic.RequestIP{
+					IPs:       []*net.IPNet{mustIPNet("192.0.2.1/32")},
+					LeaseTime: 1 * time.Second,
+				}, nil
+			}
+
+			// Never respond to renewals.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var events []wgdynamic.LeaseEvent
+	cfg := &wgdynamic.MaintainConfig{
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		OnEvent: func(e wgdynamic.LeaseEvent) {
+			events = append(events, e)
+			if e.Type == wgdynamic.LeaseLost {
+				cancel()
+			}
+		},
+	}
+
+	if err := c.Maintain(ctx, nil, cfg); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, but got: %v", err)
+	}
+
+	var types []wgdynamic.LeaseEventType
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+
+	want := []wgdynamic.LeaseEventType{
+		wgdynamic.LeaseAcquired,
+		wgdynamic.LeaseLost,
+	}
+
+	if diff := cmp.Diff(want, types); diff != "" {
+		t.Fatalf("unexpected events (-want +got):\n%s", diff)
+	}
+
+	// The renewal times out when the lease expires.
+	if err := events[1].Err; err == nil {
+		t.Fatal("expected an error for the lost lease, but none occurred")
+	}
+}
+
+func TestClientMaintainBadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *wgdynamic.RequestIP
+		cfg  *wgdynamic.MaintainConfig
+	}{
+		{
+			name: "lease start",
+			req:  &wgdynamic.RequestIP{LeaseStart: time.Unix(1, 0)},
+		},
+		{
+			name: "T1 after T2",
+			cfg: &wgdynamic.MaintainConfig{
+				T1: 0.9,
+				T2: 0.5,
+			},
+		},
+		{
+			name: "T2 too large",
+			cfg:  &wgdynamic.MaintainConfig{T2: 1},
+		},
+		{
+			name: "backoff",
+			cfg: &wgdynamic.MaintainConfig{
+				MinBackoff: 2 * time.Second,
+				MaxBackoff: 1 * time.Second,
+			},
+		},
+		{
+			name: "request timeout",
+			cfg:  &wgdynamic.MaintainConfig{RequestTimeout: -1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A zero-value Client is sufficient for this test, and will also
+			// panic if the network is accessed.
+			var c wgdynamic.Client
+			if err := c.Maintain(context.Background(), tt.req, tt.cfg); err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package wgdynamic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ expvar.Var   = &Metrics{}
+	_ http.Handler = &Metrics{}
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets used for
+// request latency histograms.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Metrics contains counters and latency histograms for the requests handled
+// by a Server or issued by a Client. A single Metrics value may be shared by
+// any number of Servers and Clients. The zero value of Metrics is ready to
+// use.
+//
+// Metrics implements expvar.Var, so it can be published using expvar.Publish,
+// and http.Handler, which serves the metrics in the Prometheus text format.
+type Metrics struct {
+	mu     sync.Mutex
+	server requestMetrics
+	client requestMetrics
+
+	// Client-only counters.
+	dials, dialFailures, failures, timeouts uint64
+}
+
+// requestMetrics contains counters and histograms for requests.
+type requestMetrics struct {
+	// Counts of requests by command and error number, where 0 indicates
+	// success.
+	requests map[requestKey]uint64
+	latency  map[requestKey]*histogram
+}
+
+// A requestKey identifies a request counter.
+type requestKey struct {
+	Command string
+	Errno   int
+}
+
+// A histogram is a cumulative latency histogram using latencyBuckets.
+type histogram struct {
+	Buckets []uint64 `json:"buckets"`
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"`
+}
+
+// observe records a request for cmd with error number errno which took d.
+func (rm *requestMetrics) observe(cmd string, errno int, d time.Duration) {
+	if rm.requests == nil {
+		rm.requests = make(map[requestKey]uint64)
+		rm.latency = make(map[requestKey]*histogram)
+	}
+
+	k := requestKey{Command: cmd, Errno: errno}
+	rm.requests[k]++
+
+	h, ok := rm.latency[k]
+	if !ok {
+		h = &histogram{Buckets: make([]uint64, len(latencyBuckets))}
+		rm.latency[k] = h
+	}
+
+	s := d.Seconds()
+	for i, b := range latencyBuckets {
+		if s <= b {
+			h.Buckets[i]++
+		}
+	}
+	h.Count++
+	h.Sum += s
+}
+
+// observeServer records the outcome of a request handled by a Server.
+func (m *Metrics) observeServer(cmd string, werr *Error, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.server.observe(cmd, errno(werr), d)
+}
+
+// observeDial records the outcome of a Client dialing a server.
+func (m *Metrics) observeDial(err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dials++
+	if err != nil {
+		m.dialFailures++
+	}
+}
+
+// observeClient records the outcome of a request issued by a Client. Protocol
+// errors are counted by error number, and all other errors are counted as
+// failures.
+func (m *Metrics) observeClient(cmd string, err error, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var werr *Error
+	switch {
+	case err == nil, errors.As(err, &werr):
+		m.client.observe(cmd, errno(werr), d)
+	default:
+		m.failures++
+		if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+			m.timeouts++
+		}
+	}
+}
+
+// errno returns the error number for err, where nil indicates success.
+func errno(err *Error) int {
+	if err == nil {
+		return 0
+	}
+
+	return err.Number
+}
+
+// jsonRequests is the JSON representation of requestMetrics.
+type jsonRequests struct {
+	Requests map[string]map[string]uint64     `json:"requests"`
+	Latency  map[string]map[string]*histogram `json:"latency"`
+}
+
+// toJSON converts rm into its JSON representation.
+func (rm *requestMetrics) toJSON() jsonRequests {
+	r := jsonRequests{
+		Requests: make(map[string]map[string]uint64),
+		Latency:  make(map[string]map[string]*histogram),
+	}
+
+	for k, v := range rm.requests {
+		if r.Requests[k.Command] == nil {
+			r.Requests[k.Command] = make(map[string]uint64)
+		}
+		r.Requests[k.Command][strconv.Itoa(k.Errno)] = v
+	}
+
+	for k, v := range rm.latency {
+		if r.Latency[k.Command] == nil {
+			r.Latency[k.Command] = make(map[string]*histogram)
+		}
+		r.Latency[k.Command][strconv.Itoa(k.Errno)] = v
+	}
+
+	return r
+}
+
+// String implements expvar.Var, returning the metrics as a JSON object.
+func (m *Metrics) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type jsonClient struct {
+		jsonRequests
+		Dials        uint64 `json:"dials"`
+		DialFailures uint64 `json:"dial_failures"`
+		Failures     uint64 `json:"failures"`
+		Timeouts     uint64 `json:"timeouts"`
+	}
+
+	b, err := json.Marshal(struct {
+		Server jsonRequests `json:"server"`
+		Client jsonClient   `json:"client"`
+	}{
+		Server: m.server.toJSON(),
+		Client: jsonClient{
+			jsonRequests: m.client.toJSON(),
+			Dials:        m.dials,
+			DialFailures: m.dialFailures,
+			Failures:     m.failures,
+			Timeouts:     m.timeouts,
+		},
+	})
+	if err != nil {
+		// Should never happen; all types are known to marshal cleanly.
+		panicf("wgdynamic: failed to marshal metrics: %v", err)
+	}
+
+	return string(b)
+}
+
+// ServeHTTP implements http.Handler, serving the metrics in the Prometheus
+// text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+
+	var b bytes.Buffer
+	m.server.writePrometheus(&b, "server")
+	m.client.writePrometheus(&b, "client")
+
+	for _, c := range []struct {
+		name, help string
+		v          uint64
+	}{
+		{name: "dials", help: "Number of connections dialed by clients.", v: m.dials},
+		{name: "dial_failures", help: "Number of failed client dials.", v: m.dialFailures},
+		{name: "failures", help: "Number of client requests which failed without a protocol error.", v: m.failures},
+		{name: "timeouts", help: "Number of client requests which timed out.", v: m.timeouts},
+	} {
+		name := "wgdynamic_client_" + c.name + "_total"
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, c.help, name, name, c.v)
+	}
+
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = b.WriteTo(w)
+}
+
+// writePrometheus writes rm to b in the Prometheus text format, using side as
+// part of each metric name.
+func (rm *requestMetrics) writePrometheus(b *bytes.Buffer, side string) {
+	name := fmt.Sprintf("wgdynamic_%s_requests_total", side)
+	fmt.Fprintf(b, "# HELP %s Number of %s requests by command and error number.\n", name, side)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+
+	keys := make([]requestKey, 0, len(rm.requests))
+	for k := range rm.requests {
+		keys = append(keys, k)
+	}
+	sortKeys(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{command=\"%s\",errno=\"%d\"} %d\n", name, labelValue(k.Command), k.Errno, rm.requests[k])
+	}
+
+	name = fmt.Sprintf("wgdynamic_%s_request_duration_seconds", side)
+	fmt.Fprintf(b, "# HELP %s Latency of %s requests by command and error number.\n", name, side)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+
+	keys = keys[:0]
+	for k := range rm.latency {
+		keys = append(keys, k)
+	}
+	sortKeys(keys)
+
+	for _, k := range keys {
+		h := rm.latency[k]
+		labels := fmt.Sprintf("command=\"%s\",errno=\"%d\"", labelValue(k.Command), k.Errno)
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n",
+				name, labels, strconv.FormatFloat(le, 'g', -1, 64), h.Buckets[i])
+		}
+
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.Count)
+		fmt.Fprintf(b, "%s_sum{%s} %g\n", name, labels, h.Sum)
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, h.Count)
+	}
+}
+
+// sortKeys sorts keys by command and error number.
+func sortKeys(keys []requestKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Command != keys[j].Command {
+			return keys[i].Command < keys[j].Command
+		}
+
+		return keys[i].Errno < keys[j].Errno
+	})
+}
+
+// labelEscaper escapes Prometheus label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue escapes s for use as a Prometheus label value.
+func labelValue(s string) string { return labelEscaper.Replace(s) }
@@ -0,0 +1,193 @@
+package wgdynamic_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestMetrics(t *testing.T) {
+	// Share a single Metrics between the Client and Server.
+	var m wgdynamic.Metrics
+
+	c, done := testServer(t, &wgdynamic.Server{
+		RequestIP: func(_ net.Addr, r *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			if len(r.IPs) > 0 {
+				return nil, wgdynamic.ErrIPUnavailable
+			}
+
+			return &wgdynamic.RequestIP{LeaseTime: 10 * time.Second}, nil
+		},
+		Metrics: &m,
+	})
+	c.Metrics = &m
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.RequestIP(context.Background(), nil); err != nil {
+			t.Fatalf("failed to request IP: %v", err)
+		}
+	}
+
+	_, err := c.RequestIP(context.Background(), &wgdynamic.RequestIP{
+		IPs: []*net.IPNet{mustIPNet("192.0.2.1/32")},
+	})
+	if diff := cmp.Diff(wgdynamic.ErrIPUnavailable, err); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+
+	// Unknown commands are recorded under a single command by the server.
+	for _, cmd := range []string{"foo", `a"b\c`} {
+		_, err := c.Do(context.Background(), &wgdynamic.Message{Command: cmd})
+		if diff := cmp.Diff(wgdynamic.ErrInvalidRequest, err); diff != "" {
+			t.Fatalf("unexpected error (-want +got):\n%s", diff)
+		}
+	}
+
+	done()
+
+	// A Client which cannot dial records a failure.
+	bad := &wgdynamic.Client{
+		Dial: func(_ context.Context) (net.Conn, error) {
+			return nil, errors.New("dial failed")
+		},
+		Metrics: &m,
+	}
+	if _, err := bad.RequestIP(context.Background(), nil); err == nil {
+		t.Fatal("expected an error, but none occurred")
+	}
+
+	var got struct {
+		Server struct {
+			Requests map[string]map[string]uint64 `json:"requests"`
+		} `json:"server"`
+		Client struct {
+			Requests     map[string]map[string]uint64 `json:"requests"`
+			Dials        uint64                       `json:"dials"`
+			DialFailures uint64                       `json:"dial_failures"`
+			Failures     uint64                       `json:"failures"`
+		} `json:"client"`
+	}
+	if err := json.Unmarshal([]byte(m.String()), &got); err != nil {
+		t.Fatalf("failed to unmarshal expvar JSON: %v", err)
+	}
+
+	want := map[string]map[string]uint64{
+		"request_ip": {"0": 2, "3": 1},
+		"unknown":    {"1": 2},
+	}
+
+	if diff := cmp.Diff(want, got.Server.Requests); diff != "" {
+		t.Fatalf("unexpected server requests (-want +got):\n%s", diff)
+	}
+
+	want = map[string]map[string]uint64{
+		"request_ip": {"0": 2, "3": 1},
+		"foo":        {"1": 1},
+		`a"b\c`:      {"1": 1},
+	}
+
+	if diff := cmp.Diff(want, got.Client.Requests); diff != "" {
+		t.Fatalf("unexpected client requests (-want +got):\n%s", diff)
+	}
+	if got.Client.Dials != 6 || got.Client.DialFailures != 1 || got.Client.Failures != 1 {
+		t.Fatalf("unexpected client counters: %+v", got.Client)
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, s := range []string{
+		`wgdynamic_server_requests_total{command="request_ip",errno="0"} 2`,
+		`wgdynamic_server_requests_total{command="request_ip",errno="3"} 1`,
+		`wgdynamic_server_request_duration_seconds_count{command="request_ip",errno="0"} 2`,
+		`wgdynamic_server_request_duration_seconds_count{command="request_ip",errno="3"} 1`,
+		`wgdynamic_client_request_duration_seconds_bucket{command="request_ip",errno="0",le="+Inf"} 2`,
+		`wgdynamic_server_requests_total{command="unknown",errno="1"} 2`,
+		`wgdynamic_client_requests_total{command="a\"b\\c",errno="1"} 1`,
+		`wgdynamic_client_dial_failures_total 1`,
+	} {
+		if !strings.Contains(w.Body.String(), s+"\n") {
+			t.Fatalf("Prometheus output does not contain %q:\n%s", s, w.Body.String())
+		}
+	}
+}
+
+func TestServerMetricsCommand(t *testing.T) {
+	mux := wgdynamic.NewServeMux()
+	mux.HandleFunc("request_ip", func(_ io.Writer, _ *wgdynamic.Request) error {
+		return wgdynamic.ErrInvalidRequest
+	})
+
+	tests := []struct {
+		name string
+		s    *wgdynamic.Server
+		want map[string]map[string]uint64
+	}{
+		{
+			name: "wrapped ServeMux",
+			s: &wgdynamic.Server{
+				Handler: wgdynamic.HandlerFunc(func(w io.Writer, r *wgdynamic.Request) error {
+					return mux.ServeWGDynamic(w, r)
+				}),
+			},
+			want: map[string]map[string]uint64{
+				"request_ip": {"1": 1},
+				"unknown":    {"1": 1},
+			},
+		},
+		{
+			name: "middleware error",
+			s: &wgdynamic.Server{
+				Handler: mux,
+				Middleware: []wgdynamic.Middleware{
+					func(_ wgdynamic.Handler) wgdynamic.Handler {
+						return wgdynamic.HandlerFunc(func(_ io.Writer, _ *wgdynamic.Request) error {
+							return wgdynamic.ErrIPUnavailable
+						})
+					},
+				},
+			},
+			want: map[string]map[string]uint64{
+				"request_ip": {"3": 1},
+				"unknown":    {"3": 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m wgdynamic.Metrics
+			tt.s.Metrics = &m
+
+			c, done := testServer(t, tt.s)
+			for _, cmd := range []string{"request_ip", "foo"} {
+				if _, err := c.Do(context.Background(), &wgdynamic.Message{Command: cmd}); err == nil {
+					t.Fatal("expected an error, but none occurred")
+				}
+			}
+			done()
+
+			var got struct {
+				Server struct {
+					Requests map[string]map[string]uint64 `json:"requests"`
+				} `json:"server"`
+			}
+			if err := json.Unmarshal([]byte(m.String()), &got); err != nil {
+				t.Fatalf("failed to unmarshal expvar JSON: %v", err)
+			}
+
+			if diff := cmp.Diff(tt.want, got.Server.Requests); diff != "" {
+				t.Fatalf("unexpected server requests (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
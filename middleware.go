@@ -0,0 +1,65 @@
+package wgdynamic
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// A Middleware wraps a Handler to apply cross-cutting behavior to every
+// request, such as logging or authorization.
+type Middleware func(h Handler) Handler
+
+// chain applies middleware to h so that the first Middleware is outermost and
+// is invoked first.
+func chain(h Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+
+	return h
+}
+
+// LogRequests produces a Middleware which logs each request's client address,
+// command, duration, and result to l.
+func LogRequests(l *log.Logger) Middleware {
+	return MeasureLatency(func(r *Request, d time.Duration, err error) {
+		result := "OK"
+		if err != nil {
+			result = err.Error()
+		}
+
+		l.Printf("%s: %q: %s (%s)", r.Addr, r.Command, result, d)
+	})
+}
+
+// Recover produces a Middleware which recovers from any panics in the next
+// Handler. A panic is converted into a generic error, which is logged by the
+// Server, and a generic protocol error is returned to the client.
+func Recover() Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(w io.Writer, r *Request) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					err = fmt.Errorf("wgdynamic: panic in %q handler: %v", r.Command, v)
+				}
+			}()
+
+			return h.ServeWGDynamic(w, r)
+		})
+	}
+}
+
+// MeasureLatency produces a Middleware which invokes fn with the duration and
+// result of each request handled by the next Handler.
+func MeasureLatency(fn func(r *Request, d time.Duration, err error)) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(w io.Writer, r *Request) error {
+			start := time.Now()
+			err := h.ServeWGDynamic(w, r)
+			fn(r, time.Since(start), err)
+			return err
+		})
+	}
+}
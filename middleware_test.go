@@ -0,0 +1,74 @@
+package wgdynamic_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestServerMiddleware(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls []string
+		lb    bytes.Buffer
+	)
+
+	record := func(name string) wgdynamic.Middleware {
+		return func(h wgdynamic.Handler) wgdynamic.Handler {
+			return wgdynamic.HandlerFunc(func(w io.Writer, r *wgdynamic.Request) error {
+				mu.Lock()
+				calls = append(calls, name+" "+r.Command)
+				mu.Unlock()
+
+				return h.ServeWGDynamic(w, r)
+			})
+		}
+	}
+
+	var latency time.Duration
+	c, done := testServer(t, &wgdynamic.Server{
+		RequestIP: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			panic("oops")
+		},
+		Middleware: []wgdynamic.Middleware{
+			record("first"),
+			record("second"),
+			wgdynamic.LogRequests(log.New(&lb, "", 0)),
+			wgdynamic.MeasureLatency(func(_ *wgdynamic.Request, d time.Duration, _ error) {
+				mu.Lock()
+				defer mu.Unlock()
+				latency = d
+			}),
+			wgdynamic.Recover(),
+		},
+	})
+
+	// The panic is recovered and a generic error is returned to the client.
+	_, err := c.RequestIP(context.Background(), nil)
+	if diff := cmp.Diff(wgdynamic.ErrInvalidRequest, err); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+
+	done()
+
+	if diff := cmp.Diff([]string{"first request_ip", "second request_ip"}, calls); diff != "" {
+		t.Fatalf("unexpected middleware calls (-want +got):\n%s", diff)
+	}
+
+	if latency == 0 {
+		t.Fatal("latency was not measured")
+	}
+
+	if !strings.Contains(lb.String(), `"request_ip": wgdynamic: panic in "request_ip" handler: oops`) {
+		t.Fatalf("unexpected log output: %q", lb.String())
+	}
+}
@@ -0,0 +1,126 @@
+package wgdynamic
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// An EventType indicates the type of an Event.
+type EventType int
+
+// Possible EventType values.
+const (
+	_ EventType = iota
+
+	// EventAccepted indicates that a connection was accepted.
+	EventAccepted
+
+	// EventParsed indicates that a request was parsed.
+	EventParsed
+
+	// EventHandled indicates that a Handler returned.
+	EventHandled
+
+	// EventErrorSent indicates that a protocol error was sent to a client.
+	EventErrorSent
+
+	// EventClosed indicates that a connection was closed.
+	EventClosed
+)
+
+// String implements fmt.Stringer.
+func (t EventType) String() string {
+	switch t {
+	case EventAccepted:
+		return "accepted"
+	case EventParsed:
+		return "parsed"
+	case EventHandled:
+		return "handled"
+	case EventErrorSent:
+		return "error sent"
+	case EventClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// An Event describes a step in the processing of a connection by a Server.
+// Fields which do not apply to an EventType are left unset.
+type Event struct {
+	// Type specifies the type of Event.
+	Type EventType
+
+	// Addr specifies the remote address of the connection.
+	Addr net.Addr
+
+	// Interface specifies the name of the network interface the connection
+	// was accepted on, if known.
+	Interface string
+
+	// Command specifies the command of the request, if one was parsed.
+	Command string
+
+	// RequestIP specifies the parameters of a request_ip command. For
+	// EventParsed, these are the parameters requested by the client. For
+	// EventHandled, these are the parameters assigned by the server if the
+	// Handler succeeded.
+	RequestIP *RequestIP
+
+	// Error specifies the protocol error sent to the client for
+	// EventErrorSent.
+	Error *Error
+
+	// Err specifies the error returned by a Handler for EventHandled, or the
+	// error which caused a protocol error to be sent for EventErrorSent.
+	Err error
+}
+
+// An Observer receives Events from a Server. Observers are invoked
+// synchronously and must be safe for concurrent use.
+type Observer interface {
+	Observe(e Event)
+}
+
+// The ObserverFunc type is an adapter to allow the use of ordinary functions
+// as Observers.
+type ObserverFunc func(e Event)
+
+// Observe implements Observer.
+func (fn ObserverFunc) Observe(e Event) { fn(e) }
+
+// observe sends e to s.Observer if it is not nil.
+func (s *Server) observe(e Event) {
+	if s.Observer == nil {
+		return
+	}
+
+	s.Observer.Observe(e)
+}
+
+// observeRequestIP parses a RequestIP from the key/value pairs of a request
+// or the serialized response in b for an Event. It returns nil if there is
+// no Observer, the command is not request_ip, or the input is invalid.
+func (s *Server) observeRequestIP(cmd string, pairs []Pair, b []byte) *RequestIP {
+	if s.Observer == nil || cmd != "request_ip" {
+		return nil
+	}
+
+	if b != nil {
+		m, err := NewDecoder(bytes.NewReader(b)).DecodeResponse(cmd)
+		if err != nil || m.Error != nil {
+			return nil
+		}
+
+		pairs = m.Pairs
+	}
+
+	rip, err := parseRequestIP(pairs, b == nil, false)
+	if err != nil {
+		return nil
+	}
+
+	return rip
+}
@@ -0,0 +1,120 @@
+package wgdynamic_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestServerObserver(t *testing.T) {
+	var (
+		ip = mustIPNet("192.0.2.1/32")
+
+		assigned = &wgdynamic.RequestIP{
+			IPs:        []*net.IPNet{ip},
+			LeaseStart: time.Unix(1, 0),
+			LeaseTime:  10 * time.Second,
+		}
+
+		mu     sync.Mutex
+		events []wgdynamic.Event
+	)
+
+	c, done := testServer(t, &wgdynamic.Server{
+		RequestIP: func(_ net.Addr, r *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			if len(r.IPs) > 0 {
+				return nil, wgdynamic.ErrIPUnavailable
+			}
+
+			return assigned, nil
+		},
+		Observer: wgdynamic.ObserverFunc(func(e wgdynamic.Event) {
+			if e.Addr == nil {
+				panicf("event has no address: %+v", e)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+		}),
+	})
+
+	if _, err := c.RequestIP(context.Background(), nil); err != nil {
+		t.Fatalf("failed to request IP: %v", err)
+	}
+
+	if _, err := c.RequestIP(context.Background(), &wgdynamic.RequestIP{
+		IPs: []*net.IPNet{ip},
+	}); err == nil {
+		t.Fatal("expected an error, but none occurred")
+	}
+
+	done()
+
+	// Group the events by connection, since one connection may be closed
+	// after the next is accepted.
+	var (
+		addrs []string
+		conns = make(map[string][]wgdynamic.Event)
+	)
+	for _, e := range events {
+		addr := e.Addr.String()
+		if _, ok := conns[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		conns[addr] = append(conns[addr], e)
+	}
+
+	var got []wgdynamic.Event
+	for _, a := range addrs {
+		got = append(got, conns[a]...)
+	}
+
+	want := []wgdynamic.Event{
+		{Type: wgdynamic.EventAccepted},
+		{
+			Type:      wgdynamic.EventParsed,
+			Command:   "request_ip",
+			RequestIP: &wgdynamic.RequestIP{},
+		},
+		{
+			Type:      wgdynamic.EventHandled,
+			Command:   "request_ip",
+			RequestIP: assigned,
+		},
+		{Type: wgdynamic.EventClosed},
+		{Type: wgdynamic.EventAccepted},
+		{
+			Type:      wgdynamic.EventParsed,
+			Command:   "request_ip",
+			RequestIP: &wgdynamic.RequestIP{IPs: []*net.IPNet{ip}},
+		},
+		{
+			Type:    wgdynamic.EventHandled,
+			Command: "request_ip",
+			Err:     wgdynamic.ErrIPUnavailable,
+		},
+		{
+			Type:    wgdynamic.EventErrorSent,
+			Command: "request_ip",
+			Error:   wgdynamic.ErrIPUnavailable,
+			Err:     wgdynamic.ErrIPUnavailable,
+		},
+		{Type: wgdynamic.EventClosed},
+	}
+
+	opts := []cmp.Option{
+		cmpopts.IgnoreFields(wgdynamic.Event{}, "Addr"),
+		cmpopts.EquateErrors(),
+	}
+
+	if diff := cmp.Diff(want, got, opts...); diff != "" {
+		t.Fatalf("unexpected events (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,114 @@
+package wgdynamic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// A Peer is the WireGuard peer which sent a request.
+type Peer struct {
+	// Interface is the name of the WireGuard interface the peer is
+	// configured on.
+	Interface string
+
+	// PublicKey is the peer's public key.
+	PublicKey wgtypes.Key
+
+	// AllowedIPs are the peer's allowed IP addresses at the time the peer was
+	// resolved.
+	AllowedIPs []net.IPNet
+}
+
+// A PeerResolver maps the source address of a request to the WireGuard peer
+// which sent it.
+//
+// Requests are sent from a peer's IPv6 link-local address, with the IPv6 zone
+// indicating the WireGuard interface which received the request. The peer is
+// identified by finding the peer on that interface whose AllowedIPs contain
+// the source address.
+type PeerResolver struct {
+	// Device is used to look up WireGuard interface peers. It must not be
+	// nil.
+	Device Device
+}
+
+// Resolve returns the Peer which sent a request from src.
+func (pr *PeerResolver) Resolve(src net.Addr) (*Peer, error) {
+	ip, iface, err := splitAddr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := pr.Device.Peers(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefer the most specific match in case of overlapping AllowedIPs.
+	var (
+		peer *wgtypes.Peer
+		best = -1
+	)
+	for i := range peers {
+		for _, aip := range peers[i].AllowedIPs {
+			ones, _ := aip.Mask.Size()
+			if aip.Contains(ip) && ones > best {
+				peer = &peers[i]
+				best = ones
+			}
+		}
+	}
+
+	if peer == nil {
+		return nil, fmt.Errorf("wgdynamic: no peer on interface %q with allowed IP %s", iface, ip)
+	}
+
+	return &Peer{
+		Interface:  iface,
+		PublicKey:  peer.PublicKey,
+		AllowedIPs: peer.AllowedIPs,
+	}, nil
+}
+
+// RequestIP wraps fn so that the Peer which sent each request is resolved
+// and passed to fn. The returned function can be used as the RequestIP
+// function for a Server. If the peer cannot be resolved, an error is returned
+// to the client.
+func (pr *PeerResolver) RequestIP(
+	fn func(p *Peer, src net.Addr, r *RequestIP) (*RequestIP, error),
+) func(src net.Addr, r *RequestIP) (*RequestIP, error) {
+	return func(src net.Addr, r *RequestIP) (*RequestIP, error) {
+		p, err := pr.Resolve(src)
+		if err != nil {
+			return nil, err
+		}
+
+		return fn(p, src, r)
+	}
+}
+
+// splitAddr returns the IP address and IPv6 zone of src.
+func splitAddr(src net.Addr) (net.IP, string, error) {
+	var (
+		ip   net.IP
+		zone string
+	)
+
+	switch a := src.(type) {
+	case *net.TCPAddr:
+		ip, zone = a.IP, a.Zone
+	case *net.IPAddr:
+		ip, zone = a.IP, a.Zone
+	default:
+		return nil, "", fmt.Errorf("wgdynamic: unsupported source address type: %T", src)
+	}
+
+	if zone == "" {
+		return nil, "", errors.New("wgdynamic: source address must specify an IPv6 zone")
+	}
+
+	return ip, zone, nil
+}
@@ -0,0 +1,94 @@
+package wgdynamic_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerResolverResolve(t *testing.T) {
+	var (
+		k1 = wgtypes.Key{1}
+		k2 = wgtypes.Key{2}
+
+		peers = []wgtypes.Peer{
+			{
+				PublicKey:  k1,
+				AllowedIPs: []net.IPNet{*mustCIDR("fe80::/64")},
+			},
+			{
+				PublicKey:  k2,
+				AllowedIPs: []net.IPNet{*mustCIDR("192.0.2.0/24"), *mustCIDR("fe80::2/128")},
+			},
+		}
+	)
+
+	d := wgdynamic.NewMemoryDevice()
+	d.SetPeers("wg0", peers)
+
+	tests := []struct {
+		name string
+		src  net.Addr
+		p    *wgdynamic.Peer
+		ok   bool
+	}{
+		{
+			name: "no zone",
+			src:  &net.TCPAddr{IP: net.ParseIP("fe80::1")},
+		},
+		{
+			name: "unknown interface",
+			src:  &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "wg1"},
+		},
+		{
+			name: "no matching peer",
+			src:  &net.TCPAddr{IP: net.ParseIP("fe81::1"), Zone: "wg0"},
+		},
+		{
+			name: "OK",
+			src:  &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "wg0"},
+			p: &wgdynamic.Peer{
+				Interface:  "wg0",
+				PublicKey:  k1,
+				AllowedIPs: peers[0].AllowedIPs,
+			},
+			ok: true,
+		},
+		{
+			name: "OK most specific",
+			src:  &net.IPAddr{IP: net.ParseIP("fe80::2"), Zone: "wg0"},
+			p: &wgdynamic.Peer{
+				Interface:  "wg0",
+				PublicKey:  k2,
+				AllowedIPs: peers[1].AllowedIPs,
+			},
+			ok: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := &wgdynamic.PeerResolver{Device: d}
+
+			p, err := pr.Resolve(tt.src)
+			if err != nil {
+				if tt.ok {
+					t.Fatalf("failed to resolve peer: %v", err)
+				}
+
+				t.Logf("OK error: %v", err)
+				return
+			}
+			if !tt.ok {
+				t.Fatal("expected an error, but none occurred")
+			}
+
+			if diff := cmp.Diff(tt.p, p); diff != "" {
+				t.Fatalf("unexpected Peer (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
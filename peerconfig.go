@@ -0,0 +1,105 @@
+package wgdynamic
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// A PeerConfigurator adds the addresses of each granted lease to the allowed
+// IPs of the WireGuard peer which holds the lease, so that traffic for those
+// addresses is routed to the peer. The addresses are removed from the peer
+// when the lease expires or is removed.
+type PeerConfigurator struct {
+	// Device is used to resolve and configure WireGuard peers. It must not be
+	// nil.
+	Device Device
+
+	// Log specifies an error logger for the PeerConfigurator. If nil, all
+	// error logs are discarded.
+	Log *log.Logger
+
+	// mu serializes configuration so that concurrent grants and revocations
+	// for the same peer cannot interleave.
+	mu sync.Mutex
+}
+
+// Attach configures m to invoke the PeerConfigurator as leases are granted,
+// renewed, and expire. Any existing callbacks set on m are invoked after the
+// PeerConfigurator. Attach must be called before m is used.
+func (pc *PeerConfigurator) Attach(m *LeaseManager) {
+	m.OnGrant = pc.chain("grant", pc.Grant, m.OnGrant)
+	m.OnRenew = pc.chain("renew", pc.Grant, m.OnRenew)
+	m.OnExpire = pc.chain("expire", pc.Revoke, m.OnExpire)
+}
+
+// Grant adds the addresses of l to the allowed IPs of the peer which holds l.
+// Grant is idempotent and can be used for both new and renewed leases.
+func (pc *PeerConfigurator) Grant(l *Lease) error {
+	return pc.configure(l, pc.Device.AddAllowedIPs)
+}
+
+// Revoke removes the addresses of l from the allowed IPs of the peer which
+// holds l.
+func (pc *PeerConfigurator) Revoke(l *Lease) error {
+	return pc.configure(l, pc.Device.RemoveAllowedIPs)
+}
+
+// configure resolves the peer which holds l and applies fn to its addresses.
+func (pc *PeerConfigurator) configure(l *Lease, fn func(iface string, key wgtypes.Key, ips []net.IPNet) error) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	src, err := clientAddr(l.Client)
+	if err != nil {
+		return err
+	}
+
+	p, err := (&PeerResolver{Device: pc.Device}).Resolve(src)
+	if err != nil {
+		return err
+	}
+
+	ips := make([]net.IPNet, 0, len(l.IPs))
+	for _, ip := range l.IPs {
+		ips = append(ips, *hostNet(ip.IP))
+	}
+
+	return fn(p.Interface, p.PublicKey, ips)
+}
+
+// chain produces a lease callback which invokes fn and then next, logging any
+// errors returned by fn.
+func (pc *PeerConfigurator) chain(op string, fn func(l *Lease) error, next func(l *Lease)) func(l *Lease) {
+	return func(l *Lease) {
+		if err := fn(l); err != nil {
+			pc.logf("%s: failed to configure peer allowed IPs for lease %s: %v", l.Client, op, err)
+		}
+
+		if next != nil {
+			next(l)
+		}
+	}
+}
+
+// logf creates a formatted log entry if pc.Log is not nil.
+func (pc *PeerConfigurator) logf(format string, v ...interface{}) {
+	if pc.Log == nil {
+		return
+	}
+
+	pc.Log.Printf(format, v...)
+}
+
+// clientAddr parses a Lease client identifier into a network address.
+func clientAddr(client string) (*net.IPAddr, error) {
+	a, err := net.ResolveIPAddr("ip", client)
+	if err != nil || a.IP == nil {
+		return nil, fmt.Errorf("wgdynamic: invalid lease client %q", client)
+	}
+
+	return a, nil
+}
@@ -0,0 +1,82 @@
+package wgdynamic_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerConfiguratorAttach(t *testing.T) {
+	var (
+		key = wgtypes.Key{1}
+		ll  = *mustCIDR("fe80::1/128")
+	)
+
+	d := wgdynamic.NewMemoryDevice()
+	d.SetPeers("wg0", []wgtypes.Peer{{
+		PublicKey:  key,
+		AllowedIPs: []net.IPNet{ll},
+	}})
+
+	p, err := wgdynamic.NewPool(mustCIDR("192.0.2.0/24"), mustCIDR("2001:db8::/64"))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	var expired bool
+	m := &wgdynamic.LeaseManager{
+		Allocate: p.RequestIP,
+		Reclaim:  p.ReleaseLease,
+		OnExpire: func(_ *wgdynamic.Lease) {
+			expired = true
+		},
+	}
+
+	pc := &wgdynamic.PeerConfigurator{Device: d}
+	pc.Attach(m)
+
+	src := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "wg0"}
+
+	// Granting and renewing a lease must only add each address once.
+	for i := 0; i < 2; i++ {
+		if _, err := m.RequestIP(src, nil); err != nil {
+			t.Fatalf("failed to request IP: %v", err)
+		}
+	}
+
+	want := []net.IPNet{
+		ll,
+		*mustIPNet("192.0.2.1/32"),
+		*mustIPNet("2001:db8::1/128"),
+	}
+
+	if diff := cmp.Diff(want, allowedIPs(t, d, "wg0")); diff != "" {
+		t.Fatalf("unexpected allowed IPs after grant (-want +got):\n%s", diff)
+	}
+
+	if !m.Remove("fe80::1%wg0") {
+		t.Fatal("expected lease to be removed")
+	}
+
+	if diff := cmp.Diff([]net.IPNet{ll}, allowedIPs(t, d, "wg0")); diff != "" {
+		t.Fatalf("unexpected allowed IPs after expiry (-want +got):\n%s", diff)
+	}
+
+	if !expired {
+		t.Fatal("existing OnExpire callback was not invoked")
+	}
+}
+
+func allowedIPs(t *testing.T, d wgdynamic.Device, iface string) []net.IPNet {
+	t.Helper()
+
+	peers, err := d.Peers(iface)
+	if err != nil {
+		t.Fatalf("failed to get peers: %v", err)
+	}
+
+	return peers[0].AllowedIPs
+}
@@ -0,0 +1,136 @@
+package wgdynamic
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An InterfacePolicy configures IP address assignment for the clients of a
+// single WireGuard interface.
+type InterfacePolicy struct {
+	// Pool allocates IP addresses for clients of the interface. Pool must not
+	// be shared with any other InterfacePolicy.
+	Pool *Pool
+
+	// LeaseTime specifies the duration of leases assigned to clients of the
+	// interface. If zero, the Pool's lease duration is used.
+	LeaseTime time.Duration
+
+	// Reservations maps the IPv6 link-local addresses of clients, such as
+	// "fe80::2", to IP addresses which are always assigned to those clients
+	// and never assigned to any other client.
+	Reservations map[string][]*net.IPNet
+
+	once sync.Once
+	err  error
+}
+
+// init applies the reservations of the policy for interface iface to its
+// Pool, exactly once.
+func (p *InterfacePolicy) init(iface string) error {
+	p.once.Do(func() {
+		if p.Pool == nil {
+			p.err = fmt.Errorf("wgdynamic: no pool configured for interface %q", iface)
+			return
+		}
+
+		// Apply reservations in a deterministic order.
+		addrs := make([]string, 0, len(p.Reservations))
+		for a := range p.Reservations {
+			addrs = append(addrs, a)
+		}
+		sort.Strings(addrs)
+
+		for _, a := range addrs {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				p.err = fmt.Errorf("wgdynamic: invalid reservation client address %q for interface %q", a, iface)
+				return
+			}
+
+			client := clientKey(&net.IPAddr{IP: ip, Zone: iface})
+			if err := p.Pool.Reserve(client, p.Reservations[a]...); err != nil {
+				p.err = fmt.Errorf("wgdynamic: failed to reserve addresses for %q: %v", client, err)
+				return
+			}
+		}
+	})
+
+	return p.err
+}
+
+// InterfacePolicies maps WireGuard interface names to the InterfacePolicy used
+// to assign IP addresses to clients of that interface. Each request is
+// assigned addresses only by the policy for the interface named by the IPv6
+// zone of its source address, so clients of one interface can never receive
+// addresses from another interface's Pool.
+type InterfacePolicies map[string]*InterfacePolicy
+
+// Validate applies the reservations of each InterfacePolicy to its Pool and
+// reports any configuration errors. Validate is called automatically on the
+// first request for each interface, but may be called at startup to detect
+// errors early.
+func (ps InterfacePolicies) Validate() error {
+	ifaces := make([]string, 0, len(ps))
+	for iface := range ps {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	for _, iface := range ifaces {
+		if err := ps[iface].init(iface); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RequestIP allocates IP addresses for the client identified by src using the
+// InterfacePolicy for the interface src was received on. It implements the
+// signature of Server.RequestIP.
+func (ps InterfacePolicies) RequestIP(src net.Addr, r *RequestIP) (*RequestIP, error) {
+	_, iface, err := splitAddr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p, ok := ps[iface]
+	if !ok {
+		return nil, fmt.Errorf("wgdynamic: no policy configured for interface %q", iface)
+	}
+
+	if err := p.init(iface); err != nil {
+		return nil, err
+	}
+
+	res, err := p.Pool.RequestIP(src, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.LeaseTime != 0 {
+		res.LeaseTime = p.LeaseTime
+	}
+
+	return res, nil
+}
+
+// ReleaseLease returns the addresses in l to the Pool of the InterfacePolicy
+// for the interface named by the IPv6 zone of l.Client, such as "wg0" for
+// "fe80::2%wg0". Leases for interfaces with no policy are ignored.
+// ReleaseLease implements the signature of LeaseManager.Reclaim.
+func (ps InterfacePolicies) ReleaseLease(l *Lease) {
+	i := strings.LastIndexByte(l.Client, '%')
+	if i == -1 {
+		return
+	}
+
+	if p, ok := ps[l.Client[i+1:]]; ok && p.Pool != nil {
+		p.Pool.ReleaseLease(l)
+	}
+}
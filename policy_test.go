@@ -0,0 +1,237 @@
+package wgdynamic_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestInterfacePoliciesRequestIP(t *testing.T) {
+	mustPool := func(s string) *wgdynamic.Pool {
+		p, err := wgdynamic.NewPool(mustCIDR(s))
+		if err != nil {
+			panicf("failed to create pool: %v", err)
+		}
+
+		return p
+	}
+
+	ps := wgdynamic.InterfacePolicies{
+		"wg0": {
+			Pool:      mustPool("192.0.2.0/24"),
+			LeaseTime: 10 * time.Minute,
+			Reservations: map[string][]*net.IPNet{
+				"fe80::10": {mustIPNet("192.0.2.1/32")},
+			},
+		},
+		"wg1": {
+			Pool: mustPool("198.51.100.0/24"),
+		},
+	}
+
+	if err := ps.Validate(); err != nil {
+		t.Fatalf("failed to validate policies: %v", err)
+	}
+
+	addr := func(ip, zone string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 970, Zone: zone}
+	}
+
+	tests := []struct {
+		name string
+		src  net.Addr
+		r    *wgdynamic.RequestIP
+		ips  []*net.IPNet
+		d    time.Duration
+		ok   bool
+	}{
+		{
+			name: "wg0 skips reserved address",
+			src:  addr("fe80::2", "wg0"),
+			ips:  []*net.IPNet{mustIPNet("192.0.2.2/32")},
+			d:    10 * time.Minute,
+			ok:   true,
+		},
+		{
+			name: "wg0 reserved",
+			src:  addr("fe80::10", "wg0"),
+			ips:  []*net.IPNet{mustIPNet("192.0.2.1/32")},
+			d:    10 * time.Minute,
+			ok:   true,
+		},
+		{
+			name: "wg0 reserved for another client",
+			src:  addr("fe80::3", "wg0"),
+			r:    &wgdynamic.RequestIP{IPs: []*net.IPNet{mustIPNet("192.0.2.1/32")}},
+		},
+		{
+			name: "wg1 same client address",
+			src:  addr("fe80::2", "wg1"),
+			ips:  []*net.IPNet{mustIPNet("198.51.100.1/32")},
+			d:    1 * time.Hour,
+			ok:   true,
+		},
+		{
+			name: "wg1 cannot request wg0 address",
+			src:  addr("fe80::3", "wg1"),
+			r:    &wgdynamic.RequestIP{IPs: []*net.IPNet{mustIPNet("192.0.2.3/32")}},
+		},
+		{
+			name: "unknown interface",
+			src:  addr("fe80::2", "wg2"),
+		},
+		{
+			name: "no zone",
+			src:  addr("fe80::2", ""),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ps.RequestIP(tt.src, tt.r)
+			if tt.ok && err != nil {
+				t.Fatalf("failed to request IP: %v", err)
+			}
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected an error, but none occurred")
+				}
+
+				return
+			}
+
+			if diff := cmp.Diff(tt.ips, res.IPs); diff != "" {
+				t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.d, res.LeaseTime); diff != "" {
+				t.Fatalf("unexpected lease time (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestInterfacePoliciesValidate(t *testing.T) {
+	p, err := wgdynamic.NewPool(mustCIDR("192.0.2.0/24"))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ps   wgdynamic.InterfacePolicies
+	}{
+		{
+			name: "no pool",
+			ps:   wgdynamic.InterfacePolicies{"wg0": {}},
+		},
+		{
+			name: "bad client address",
+			ps: wgdynamic.InterfacePolicies{"wg0": {
+				Pool: p,
+				Reservations: map[string][]*net.IPNet{
+					"foo": {mustIPNet("192.0.2.1/32")},
+				},
+			}},
+		},
+		{
+			name: "reservation outside pool",
+			ps: wgdynamic.InterfacePolicies{"wg0": {
+				Pool: p,
+				Reservations: map[string][]*net.IPNet{
+					"fe80::2": {mustIPNet("198.51.100.1/32")},
+				},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.ps.Validate(); err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+		})
+	}
+}
+
+func TestInterfacePoliciesReleaseLease(t *testing.T) {
+	mustPool := func(s string) *wgdynamic.Pool {
+		p, err := wgdynamic.NewPool(mustCIDR(s))
+		if err != nil {
+			panicf("failed to create pool: %v", err)
+		}
+
+		return p
+	}
+
+	// Both interfaces use the same subnet, so leases can only be reclaimed
+	// using the interface of the client.
+	ps := wgdynamic.InterfacePolicies{
+		"wg0": {Pool: mustPool("192.0.2.0/30")},
+		"wg1": {
+			Pool:      mustPool("192.0.2.0/30"),
+			LeaseTime: 50 * time.Millisecond,
+		},
+	}
+
+	expireC := make(chan *wgdynamic.Lease, 1)
+	m := &wgdynamic.LeaseManager{
+		Allocate: ps.RequestIP,
+		Reclaim:  ps.ReleaseLease,
+		OnExpire: func(l *wgdynamic.Lease) {
+			expireC <- l
+		},
+	}
+
+	addr := func(ip, zone string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 970, Zone: zone}
+	}
+
+	ip := []*net.IPNet{mustIPNet("192.0.2.1/32")}
+	for _, src := range []net.Addr{addr("fe80::2", "wg0"), addr("fe80::2", "wg1")} {
+		res, err := m.RequestIP(src, nil)
+		if err != nil {
+			t.Fatalf("failed to request IP: %v", err)
+		}
+
+		if diff := cmp.Diff(ip, res.IPs); diff != "" {
+			t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { _ = m.Run(ctx) }()
+
+	// Wait for the wg1 lease to expire.
+	if diff := cmp.Diff("fe80::2%wg1", (<-expireC).Client); diff != "" {
+		t.Fatalf("unexpected expired lease client (-want +got):\n%s", diff)
+	}
+	cancel()
+
+	tests := []struct {
+		src net.Addr
+		ips []*net.IPNet
+	}{
+		// The expired address is available again on wg1, but is still
+		// leased on wg0.
+		{src: addr("fe80::3", "wg1"), ips: ip},
+		{src: addr("fe80::3", "wg0"), ips: []*net.IPNet{mustIPNet("192.0.2.2/32")}},
+	}
+
+	for _, tt := range tests {
+		res, err := ps.RequestIP(tt.src, nil)
+		if err != nil {
+			t.Fatalf("failed to request IP: %v", err)
+		}
+
+		if diff := cmp.Diff(tt.ips, res.IPs); diff != "" {
+			t.Fatalf("unexpected IPs for %s (-want +got):\n%s", tt.src, diff)
+		}
+	}
+}
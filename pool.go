@@ -0,0 +1,437 @@
+package wgdynamic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultLeaseTime is the lease duration used by a Pool when none is set.
+const defaultLeaseTime = 1 * time.Hour
+
+// A Pool is an IP address allocator which hands out individual IPv4 and IPv6
+// addresses from a set of subnets. Pool.RequestIP can be used directly as
+// the RequestIP function for a Server.
+//
+// Each client is identified by its source address, and a client which makes
+// repeated requests is assigned the same addresses for as long as they remain
+// allocated.
+type Pool struct {
+	// LeaseTime specifies the duration of leases handed out by the Pool. If
+	// zero, a default of one hour is used.
+	LeaseTime time.Duration
+
+	mu      sync.Mutex
+	subnets []*net.IPNet
+	// Maps IP addresses to their owners and owners to their IP addresses.
+	owners  map[string]string
+	clients map[string][]*net.IPNet
+	// Maps reserved IP addresses to their clients and clients to their
+	// reserved IP addresses.
+	reserved     map[string]string
+	reservations map[string][]*net.IPNet
+}
+
+// NewPool creates a Pool which allocates addresses from the input IPv4 and/or
+// IPv6 subnets. At least one subnet must be specified.
+func NewPool(subnets ...*net.IPNet) (*Pool, error) {
+	if len(subnets) == 0 {
+		return nil, errors.New("wgdynamic: at least one subnet must be specified for a pool")
+	}
+
+	ss := make([]*net.IPNet, 0, len(subnets))
+	for _, s := range subnets {
+		if s == nil {
+			return nil, errors.New("wgdynamic: pool subnets must not be nil")
+		}
+
+		// Normalize the subnet so that all addresses are stored in their
+		// canonical length and the address is the first in the subnet.
+		ip := s.IP.Mask(s.Mask)
+		if ip == nil {
+			return nil, fmt.Errorf("wgdynamic: invalid pool subnet: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		ss = append(ss, &net.IPNet{
+			IP:   ip,
+			Mask: s.Mask,
+		})
+	}
+
+	return &Pool{
+		subnets:      ss,
+		owners:       make(map[string]string),
+		clients:      make(map[string][]*net.IPNet),
+		reserved:     make(map[string]string),
+		reservations: make(map[string][]*net.IPNet),
+	}, nil
+}
+
+// RequestIP allocates IP addresses for the client identified by src. It
+// implements the signature of Server.RequestIP.
+//
+// One address is allocated from each IP family configured in the Pool. If r
+// requests specific addresses, those addresses are assigned if they are free.
+// ErrIPUnavailable is returned if any requested address is in use or outside
+// of the Pool, or if the Pool has no free addresses remaining.
+func (p *Pool) RequestIP(src net.Addr, r *RequestIP) (*RequestIP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	client := clientKey(src)
+
+	var want []*net.IPNet
+	if r != nil {
+		want = r.IPs
+	}
+
+	ips, err := p.allocate(client, want)
+	if err != nil {
+		return nil, err
+	}
+
+	d := p.LeaseTime
+	if d == 0 {
+		d = defaultLeaseTime
+	}
+
+	return &RequestIP{
+		IPs:        ips,
+		LeaseStart: time.Now(),
+		LeaseTime:  d,
+	}, nil
+}
+
+// Release returns the input IP addresses to the Pool so that they may be
+// assigned to other clients. Addresses which are not allocated are ignored.
+func (p *Pool) Release(ips ...*net.IPNet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, ip := range ips {
+		p.release(ip.IP)
+	}
+}
+
+// ReleaseLease returns the addresses in l which are assigned to l.Client to
+// the Pool, such as when l expires. Addresses assigned to any other client are
+// ignored.
+func (p *Pool) ReleaseLease(l *Lease) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, ip := range l.IPs {
+		if p.owners[ip.IP.String()] == l.Client {
+			p.release(ip.IP)
+		}
+	}
+}
+
+// Restore marks the addresses in l as assigned to l.Client, such as when
+// reloading leases from a LeaseStore at startup. ErrIPUnavailable is returned
+// if any of the addresses are outside of the Pool or assigned to another
+// client.
+func (p *Pool) Restore(l *Lease) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.available(l.Client, l.IPs) {
+		return ErrIPUnavailable
+	}
+
+	for _, ip := range p.clients[l.Client] {
+		delete(p.owners, ip.IP.String())
+	}
+
+	ips := make([]*net.IPNet, 0, len(l.IPs))
+	for _, ip := range l.IPs {
+		ips = append(ips, hostNet(ip.IP))
+		p.owners[ip.IP.String()] = l.Client
+	}
+	p.clients[l.Client] = ips
+
+	return nil
+}
+
+// Reserve reserves the input IP addresses for client, such as "fe80::2%wg0".
+// Reserved addresses are never assigned to any other client, and are assigned
+// to client in preference to any other addresses of the same family.
+// ErrIPUnavailable is returned if any of the addresses are outside of the Pool,
+// or are reserved for or assigned to another client.
+func (p *Pool) Reserve(client string, ips ...*net.IPNet) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.available(client, ips) {
+		return ErrIPUnavailable
+	}
+
+	for _, ip := range ips {
+		p.reserved[ip.IP.String()] = client
+		p.reservations[client] = append(p.reservations[client], hostNet(ip.IP))
+	}
+
+	return nil
+}
+
+// allocate assigns addresses to client, preferring the addresses in want.
+// p.mu must be held when calling allocate.
+func (p *Pool) allocate(client string, want []*net.IPNet) ([]*net.IPNet, error) {
+	// Verify all of the requested addresses can be assigned before making
+	// any changes to the Pool's state.
+	if !p.available(client, want) {
+		return nil, ErrIPUnavailable
+	}
+
+	current := p.clients[client]
+
+	var (
+		ips   []*net.IPNet
+		fresh []net.IP
+	)
+	for _, family := range []bool{true, false} {
+		if !p.hasFamily(family) {
+			continue
+		}
+
+		// Reserved addresses take precedence over requested addresses,
+		// which take precedence over existing assignments, which take
+		// precedence over newly allocated addresses.
+		if ip := findFamily(p.reservations[client], family); ip != nil {
+			ips = append(ips, hostNet(ip))
+			continue
+		}
+		if ip := findFamily(want, family); ip != nil {
+			ips = append(ips, hostNet(ip))
+			continue
+		}
+		if ip := findFamily(current, family); ip != nil {
+			ips = append(ips, hostNet(ip))
+			continue
+		}
+
+		ip, ok := p.free(family, fresh)
+		if !ok {
+			return nil, ErrIPUnavailable
+		}
+
+		fresh = append(fresh, ip)
+		ips = append(ips, hostNet(ip))
+	}
+
+	// Replace the client's previous assignments with the new ones.
+	for _, ip := range current {
+		delete(p.owners, ip.IP.String())
+	}
+	for _, ip := range ips {
+		p.owners[ip.IP.String()] = client
+	}
+	p.clients[client] = ips
+
+	return cloneIPNets(ips), nil
+}
+
+// available reports whether all of ips are within the Pool and either free or
+// already assigned to or reserved for client. p.mu must be held when calling
+// available.
+func (p *Pool) available(client string, ips []*net.IPNet) bool {
+	for _, ip := range ips {
+		if ip == nil {
+			return false
+		}
+
+		s := p.subnet(ip.IP)
+		if s == nil || excluded(s, ip.IP) {
+			return false
+		}
+
+		key := ip.IP.String()
+		if owner, ok := p.owners[key]; ok && owner != client {
+			return false
+		}
+		if owner, ok := p.reserved[key]; ok && owner != client {
+			return false
+		}
+	}
+
+	return true
+}
+
+// release frees ip. p.mu must be held when calling release.
+func (p *Pool) release(ip net.IP) {
+	key := ip.String()
+	client, ok := p.owners[key]
+	if !ok {
+		return
+	}
+	delete(p.owners, key)
+
+	var ips []*net.IPNet
+	for _, cip := range p.clients[client] {
+		if !cip.IP.Equal(ip) {
+			ips = append(ips, cip)
+		}
+	}
+
+	if len(ips) == 0 {
+		delete(p.clients, client)
+		return
+	}
+	p.clients[client] = ips
+}
+
+// free finds a free address of the specified family which is not also present
+// in skip. p.mu must be held when calling free.
+func (p *Pool) free(isIPv4 bool, skip []net.IP) (net.IP, bool) {
+	for _, s := range p.subnets {
+		if (s.IP.To4() != nil) != isIPv4 {
+			continue
+		}
+
+		for ip := s.IP; s.Contains(ip); ip = nextIP(ip) {
+			if excluded(s, ip) {
+				continue
+			}
+
+			key := ip.String()
+			if _, ok := p.owners[key]; ok || containsIP(skip, ip) {
+				continue
+			}
+			if _, ok := p.reserved[key]; ok {
+				continue
+			}
+
+			return ip, true
+		}
+	}
+
+	return nil, false
+}
+
+// excluded reports whether ip is the network address of s, or the broadcast
+// address of IPv4 subnet s, for subnets with more than two addresses. These
+// addresses are never assigned to clients.
+func excluded(s *net.IPNet, ip net.IP) bool {
+	ones, bits := s.Mask.Size()
+	if bits-ones <= 1 {
+		return false
+	}
+	if ip.Equal(s.IP) {
+		return true
+	}
+
+	return s.IP.To4() != nil && !s.Contains(nextIP(ip))
+}
+
+// subnet returns the Pool subnet which contains ip, or nil if none do.
+func (p *Pool) subnet(ip net.IP) *net.IPNet {
+	for _, s := range p.subnets {
+		if s.Contains(ip) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// hasFamily reports whether the Pool has any subnets of the specified family.
+func (p *Pool) hasFamily(isIPv4 bool) bool {
+	for _, s := range p.subnets {
+		if (s.IP.To4() != nil) == isIPv4 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientKey produces a key which identifies a client by its source address.
+// The port is omitted because it does not identify a client.
+func clientKey(src net.Addr) string {
+	switch a := src.(type) {
+	case *net.TCPAddr:
+		return (&net.IPAddr{IP: a.IP, Zone: a.Zone}).String()
+	case *net.IPAddr:
+		return a.String()
+	case nil:
+		return ""
+	default:
+		return a.String()
+	}
+}
+
+// findFamily returns the first IP address of the specified family in ips.
+func findFamily(ips []*net.IPNet, isIPv4 bool) net.IP {
+	for _, ip := range ips {
+		if ip != nil && (ip.IP.To4() != nil) == isIPv4 {
+			return ip.IP
+		}
+	}
+
+	return nil
+}
+
+// hostNet produces a /32 or /128 *net.IPNet for ip, in the same form as
+// addresses parsed from the wire.
+func hostNet(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{
+			IP:   ip.To16(),
+			Mask: net.CIDRMask(32, 32),
+		}
+	}
+
+	return &net.IPNet{
+		IP:   ip.To16(),
+		Mask: net.CIDRMask(128, 128),
+	}
+}
+
+// nextIP returns the IP address immediately following ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+
+	return next
+}
+
+// containsIP reports whether ip is present in ips.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cloneIPNets produces a deep copy of ips so that callers cannot modify the
+// Pool's internal state.
+func cloneIPNets(ips []*net.IPNet) []*net.IPNet {
+	if ips == nil {
+		return nil
+	}
+
+	out := make([]*net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, &net.IPNet{
+			IP:   append(net.IP(nil), ip.IP...),
+			Mask: append(net.IPMask(nil), ip.Mask...),
+		})
+	}
+
+	return out
+}
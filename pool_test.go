@@ -0,0 +1,226 @@
+package wgdynamic_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/wgdynamic-go"
+)
+
+func TestNewPoolErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnets []*net.IPNet
+	}{
+		{
+			name: "no subnets",
+		},
+		{
+			name:    "nil subnet",
+			subnets: []*net.IPNet{nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := wgdynamic.NewPool(tt.subnets...); err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+		})
+	}
+}
+
+func TestPoolRequestIP(t *testing.T) {
+	var (
+		c1 = &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 970, Zone: "wg0"}
+		c2 = &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 970, Zone: "wg0"}
+	)
+
+	tests := []struct {
+		name    string
+		subnets []*net.IPNet
+		fn      func(t *testing.T, p *wgdynamic.Pool)
+	}{
+		{
+			name:    "auto assign IPv4 and IPv6",
+			subnets: []*net.IPNet{mustCIDR("192.0.2.0/24"), mustCIDR("2001:db8::/64")},
+			fn: func(t *testing.T, p *wgdynamic.Pool) {
+				want := []*net.IPNet{
+					mustIPNet("192.0.2.1/32"),
+					mustIPNet("2001:db8::1/128"),
+				}
+
+				if diff := cmp.Diff(want, mustRequest(t, p, c1, nil).IPs); diff != "" {
+					t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+				}
+
+				// A second request from the same client returns the same
+				// addresses.
+				if diff := cmp.Diff(want, mustRequest(t, p, c1, nil).IPs); diff != "" {
+					t.Fatalf("unexpected renewed IPs (-want +got):\n%s", diff)
+				}
+
+				// Another client receives the next addresses.
+				want = []*net.IPNet{
+					mustIPNet("192.0.2.2/32"),
+					mustIPNet("2001:db8::2/128"),
+				}
+
+				if diff := cmp.Diff(want, mustRequest(t, p, c2, nil).IPs); diff != "" {
+					t.Fatalf("unexpected IPs for second client (-want +got):\n%s", diff)
+				}
+			},
+		},
+		{
+			name:    "request specific",
+			subnets: []*net.IPNet{mustCIDR("192.0.2.0/24"), mustCIDR("2001:db8::/64")},
+			fn: func(t *testing.T, p *wgdynamic.Pool) {
+				want := []*net.IPNet{
+					mustIPNet("192.0.2.10/32"),
+					mustIPNet("2001:db8::1/128"),
+				}
+
+				got := mustRequest(t, p, c1, &wgdynamic.RequestIP{
+					IPs: []*net.IPNet{mustIPNet("192.0.2.10/32")},
+				})
+
+				if diff := cmp.Diff(want, got.IPs); diff != "" {
+					t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+				}
+
+				// The same address is unavailable to another client.
+				_, err := p.RequestIP(c2, &wgdynamic.RequestIP{
+					IPs: []*net.IPNet{mustIPNet("192.0.2.10/32")},
+				})
+				if diff := cmp.Diff(wgdynamic.ErrIPUnavailable, err); diff != "" {
+					t.Fatalf("unexpected error (-want +got):\n%s", diff)
+				}
+			},
+		},
+		{
+			name:    "request outside pool",
+			subnets: []*net.IPNet{mustCIDR("192.0.2.0/24")},
+			fn: func(t *testing.T, p *wgdynamic.Pool) {
+				_, err := p.RequestIP(c1, &wgdynamic.RequestIP{
+					IPs: []*net.IPNet{mustIPNet("2001:db8::1/128")},
+				})
+				if diff := cmp.Diff(wgdynamic.ErrIPUnavailable, err); diff != "" {
+					t.Fatalf("unexpected error (-want +got):\n%s", diff)
+				}
+			},
+		},
+		{
+			name:    "request network and broadcast",
+			subnets: []*net.IPNet{mustCIDR("192.0.2.0/24"), mustCIDR("2001:db8::/64")},
+			fn: func(t *testing.T, p *wgdynamic.Pool) {
+				for _, s := range []string{"192.0.2.0/32", "192.0.2.255/32", "2001:db8::/128"} {
+					_, err := p.RequestIP(c1, &wgdynamic.RequestIP{
+						IPs: []*net.IPNet{mustIPNet(s)},
+					})
+					if diff := cmp.Diff(wgdynamic.ErrIPUnavailable, err); diff != "" {
+						t.Fatalf("unexpected error for %s (-want +got):\n%s", s, diff)
+					}
+				}
+
+				// The last IPv6 address has no broadcast equivalent.
+				got := mustRequest(t, p, c1, &wgdynamic.RequestIP{
+					IPs: []*net.IPNet{mustIPNet("2001:db8::ffff:ffff:ffff:ffff/128")},
+				})
+
+				want := []*net.IPNet{
+					mustIPNet("192.0.2.1/32"),
+					mustIPNet("2001:db8::ffff:ffff:ffff:ffff/128"),
+				}
+				if diff := cmp.Diff(want, got.IPs); diff != "" {
+					t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+				}
+			},
+		},
+		{
+			name:    "exhausted and released",
+			subnets: []*net.IPNet{mustCIDR("192.0.2.0/30")},
+			fn: func(t *testing.T, p *wgdynamic.Pool) {
+				// Only two usable addresses exist in a /30.
+				mustRequest(t, p, c1, nil)
+				got := mustRequest(t, p, c2, nil)
+
+				c3 := &net.TCPAddr{IP: net.ParseIP("fe80::3"), Zone: "wg0"}
+				_, err := p.RequestIP(c3, nil)
+				if diff := cmp.Diff(wgdynamic.ErrIPUnavailable, err); diff != "" {
+					t.Fatalf("unexpected error (-want +got):\n%s", diff)
+				}
+
+				// Once an address is released, it can be reused.
+				p.Release(got.IPs...)
+
+				want := []*net.IPNet{mustIPNet("192.0.2.2/32")}
+				if diff := cmp.Diff(want, mustRequest(t, p, c3, nil).IPs); diff != "" {
+					t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+				}
+			},
+		},
+		{
+			name:    "restore",
+			subnets: []*net.IPNet{mustCIDR("192.0.2.0/24")},
+			fn: func(t *testing.T, p *wgdynamic.Pool) {
+				l := &wgdynamic.Lease{
+					Client: "fe80::1%wg0",
+					IPs:    []*net.IPNet{mustIPNet("192.0.2.20/32")},
+				}
+
+				if err := p.Restore(l); err != nil {
+					t.Fatalf("failed to restore lease: %v", err)
+				}
+
+				// The restored lease cannot be taken by another client, but
+				// is returned to the client which holds it.
+				err := p.Restore(&wgdynamic.Lease{Client: "fe80::2%wg0", IPs: l.IPs})
+				if diff := cmp.Diff(wgdynamic.ErrIPUnavailable, err); diff != "" {
+					t.Fatalf("unexpected error (-want +got):\n%s", diff)
+				}
+
+				if diff := cmp.Diff(l.IPs, mustRequest(t, p, c1, nil).IPs); diff != "" {
+					t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := wgdynamic.NewPool(tt.subnets...)
+			if err != nil {
+				t.Fatalf("failed to create pool: %v", err)
+			}
+			p.LeaseTime = 10 * time.Second
+
+			tt.fn(t, p)
+		})
+	}
+}
+
+func mustRequest(t *testing.T, p *wgdynamic.Pool, src net.Addr, r *wgdynamic.RequestIP) *wgdynamic.RequestIP {
+	t.Helper()
+
+	res, err := p.RequestIP(src, r)
+	if err != nil {
+		t.Fatalf("failed to request IP: %v", err)
+	}
+
+	if res.LeaseStart.IsZero() || res.LeaseTime != 10*time.Second {
+		t.Fatalf("unexpected lease parameters: %v, %v", res.LeaseStart, res.LeaseTime)
+	}
+
+	return res
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, ipn, err := net.ParseCIDR(s)
+	if err != nil {
+		panicf("failed to parse CIDR: %v", err)
+	}
+
+	return ipn
+}
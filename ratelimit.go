@@ -0,0 +1,104 @@
+package wgdynamic
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errRateLimited indicates that a request was rejected by a rateLimiter.
+var errRateLimited = errors.New("wgdynamic: request exceeded rate limit")
+
+// A rateLimiter is a token bucket rate limiter which tracks a separate bucket
+// for each key.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	// now is a hook for tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// A bucket contains the tokens available for a single key.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a rateLimiter which allows rate events per second
+// with bursts of up to burst events for each key. If burst is less than 1,
+// a burst of 1 is used.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow reports whether an event for key is permitted, consuming a token if
+// so.
+func (rl *rateLimiter) allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{
+			tokens: rl.burst,
+			last:   now,
+		}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = rl.refill(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// refill returns the number of tokens available in b at time now.
+func (rl *rateLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rl.rate
+	if tokens > rl.burst {
+		tokens = rl.burst
+	}
+
+	return tokens
+}
+
+// sweep periodically removes any buckets which have refilled completely, so
+// that memory is not consumed by keys which are no longer active. The caller
+// must hold rl.mu.
+func (rl *rateLimiter) sweep(now time.Time) {
+	// A bucket refills completely after this interval, so there is no need to
+	// sweep more often.
+	interval := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	if now.Sub(rl.swept) < interval {
+		return
+	}
+	rl.swept = now
+
+	for k, b := range rl.buckets {
+		if rl.refill(b, now) >= rl.burst {
+			delete(rl.buckets, k)
+		}
+	}
+}
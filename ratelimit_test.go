@@ -0,0 +1,46 @@
+package wgdynamic
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	// One event per second with bursts of two events.
+	rl := newRateLimiter(1, 2)
+	rl.now = func() time.Time { return now }
+
+	steps := []struct {
+		d     time.Duration
+		key   string
+		allow bool
+	}{
+		{key: "a", allow: true},
+		{key: "a", allow: true},
+		{key: "a", allow: false},
+		// Each key has its own bucket.
+		{key: "b", allow: true},
+		// Tokens are replenished over time.
+		{d: 500 * time.Millisecond, key: "a", allow: false},
+		{d: 500 * time.Millisecond, key: "a", allow: true},
+		{key: "a", allow: false},
+		// Buckets never exceed the burst size.
+		{d: 10 * time.Second, key: "a", allow: true},
+		{key: "a", allow: true},
+		{key: "a", allow: false},
+	}
+
+	for i, s := range steps {
+		now = now.Add(s.d)
+		if got := rl.allow(s.key); got != s.allow {
+			t.Fatalf("step %d: unexpected allow for %q: %v", i, s.key, got)
+		}
+	}
+
+	// Key b's bucket has refilled and should have been swept.
+	if _, ok := rl.buckets["b"]; ok {
+		t.Fatal("expected idle bucket to be swept")
+	}
+}
@@ -2,32 +2,131 @@ package wgdynamic
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 // A Server serves wg-dynamic protocol requests.
 //
-// Each exported function field implements a specific request. If any errors
-// are returned, a protocol error is returned to the client. When the error is
-// of type *Error, that protocol error is returned to the client. For generic
-// errors, a generic protocol error is returned.
+// Requests are dispatched to Handler. Each exported function field is a
+// convenience which implements a specific request. If any errors are returned,
+// a protocol error is returned to the client. When the error is of type *Error,
+// that protocol error is returned to the client. For generic errors, a generic
+// protocol error is returned.
 type Server struct {
+	// Handler handles all requests. If nil, a ServeMux is used.
+	//
+	// If Handler is nil or a *ServeMux, any non-nil function fields handle
+	// version 1 of commands which do not have a Handler registered with the
+	// ServeMux for that version. The ServeMux is not modified, so it may be
+	// shared by multiple Servers.
+	Handler Handler
+
 	// RequestIP handles requests for IP address assignment. If nil, a generic
 	// protocol error is returned to the client.
 	RequestIP func(src net.Addr, r *RequestIP) (*RequestIP, error)
 
+	// RequestIPContext is like RequestIP, but receives the context of the
+	// request, as described by Request.Context. If set, it is used in place of
+	// RequestIP.
+	RequestIPContext func(ctx context.Context, src net.Addr, r *RequestIP) (*RequestIP, error)
+
+	// Middleware specifies optional Middleware which are applied to every
+	// request. The first Middleware is outermost and is invoked first.
+	Middleware []Middleware
+
+	// ReadTimeout specifies the maximum duration for reading a request from
+	// a connection. If zero, there is no timeout.
+	ReadTimeout time.Duration
+
+	// WriteTimeout specifies the maximum duration for writing a response to
+	// a connection. If zero, there is no timeout.
+	WriteTimeout time.Duration
+
+	// HandlerTimeout specifies the maximum duration for a Handler to process
+	// a request. If the timeout expires, a generic protocol error is returned
+	// to the client. If zero, there is no timeout.
+	//
+	// A Handler which exceeds the timeout is not interrupted: it continues to
+	// run, Close waits for it to return, and its response is discarded. Any
+	// state it changes, such as an address allocated from a Pool, is not
+	// rolled back. Handlers should use the request's Context, for example by
+	// setting RequestIPContext, to abandon work once the timeout expires.
+	HandlerTimeout time.Duration
+
+	// Strict enables strict validation of client requests. Requests with
+	// unknown or duplicate keys, invalid values, or keys which are not valid
+	// in a client request receive a generic protocol error, and the error
+	// naming the offending line is logged.
+	Strict bool
+
+	// MaxLineLength, MaxPairs, and MaxIPs specify limits on the length of
+	// each line, the number of key/value pairs, and the number of IP addresses
+	// in a request. If a request exceeds any limit, a generic protocol error is
+	// returned to the client. If zero, defaults of 1024 bytes, 64 pairs, and
+	// 16 IP addresses are used.
+	MaxLineLength int
+	MaxPairs      int
+	MaxIPs        int
+
+	// MaxConnections specifies the maximum number of connections which may be
+	// handled concurrently. Once the limit is reached, the Server delays
+	// accepting new connections until an active connection is closed. If zero,
+	// there is no limit.
+	MaxConnections int
+
+	// PeerRate and PeerBurst configure a token bucket rate limiter for each
+	// peer, keyed on the remote address of a connection. PeerRate specifies the
+	// sustained number of requests per second and PeerBurst specifies the
+	// maximum burst of requests. Requests which exceed the limit receive a
+	// generic protocol error. If PeerRate is zero, there is no limit. If
+	// PeerBurst is zero, a burst of 1 request is used.
+	PeerRate  float64
+	PeerBurst int
+
+	// Metrics specifies optional Metrics which record the outcome and latency
+	// of each request. If nil, no metrics are recorded. Requests are recorded
+	// by command only if the command is registered with a ServeMux, including
+	// one wrapped by another Handler, or handled by RequestIP or
+	// RequestIPContext. All other requests are recorded under the command
+	// "unknown".
+	Metrics *Metrics
+
+	// PeerResolver specifies an optional PeerResolver which is used to
+	// identify the WireGuard peer which sent each request. The Peer is
+	// available from the request's RequestInfo. If nil, or if the peer cannot
+	// be resolved, no Peer is set.
+	PeerResolver *PeerResolver
+
+	// Observer specifies an optional Observer which receives structured
+	// Events as each connection is processed. If nil, no Events are produced.
+	Observer Observer
+
 	// Log specifies an error logger for the Server. If nil, all error logs
 	// are discarded.
 	Log *log.Logger
 
 	// Guards internal fields set when Serve is first called.
-	mu sync.Mutex
-	l  net.Listener
-	wg *sync.WaitGroup
+	mu        sync.Mutex
+	h         Handler
+	known     func(command string) bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    bool
+	doneC     chan struct{}
+	sem       chan struct{}
+	rl        *rateLimiter
+
+	// Tracks active connection handlers.
+	wg sync.WaitGroup
 }
 
 // Listen creates a net.Listener suitable for use with a Server and bound to
@@ -57,100 +156,536 @@ func Listen(iface string) (net.Listener, error) {
 	})
 }
 
-// Serve serves incoming requests by accepting connections from l.
+// ErrServerClosed is returned by Server.Serve after a call to Server.Close or
+// Server.Shutdown.
+var ErrServerClosed = errors.New("wgdynamic: Server closed")
+
+// Serve serves incoming requests by accepting connections from l. Serve always
+// returns a non-nil error. After Close or Shutdown, the returned error is
+// ErrServerClosed.
+//
+// Serve may be called concurrently with multiple listeners, such as one
+// per WireGuard interface created by Listen, and all requests are dispatched
+// to the same Handler. The name of the interface a request was received on is
+// available in Request.Interface.
 func (s *Server) Serve(l net.Listener) error {
 	// Initialize any necessary fields before starting the listener loop.
 	s.mu.Lock()
-	s.l = l
-	s.wg = &sync.WaitGroup{}
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return ErrServerClosed
+	}
+
+	if s.h == nil {
+		s.h, s.known = s.handler()
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+
+	if s.doneC == nil {
+		s.doneC = make(chan struct{})
+	}
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	if s.sem == nil && s.MaxConnections > 0 {
+		s.sem = make(chan struct{}, s.MaxConnections)
+	}
+	if s.rl == nil && s.PeerRate > 0 {
+		s.rl = newRateLimiter(s.PeerRate, s.PeerBurst)
+	}
 	s.mu.Unlock()
 
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.listeners, l)
+	}()
+
+	iface := listenerInterface(l)
+
 	for {
+		if !s.acquire() {
+			return ErrServerClosed
+		}
+
 		c, err := l.Accept()
 		if err != nil {
+			s.release()
+
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+
 			return err
 		}
 
-		// Guard s.wg to prevent a data race when another goroutine tries to
-		// wait during a call to Close.
+		// Track each connection so it can be forcibly closed, and guard s.wg
+		// to prevent a data race when another goroutine tries to wait during
+		// a call to Close or Shutdown.
 		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = c.Close()
+			s.release()
+			return ErrServerClosed
+		}
+
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
+		}
+		s.conns[c] = struct{}{}
 		s.wg.Add(1)
 		s.mu.Unlock()
 
+		s.observe(Event{Type: EventAccepted, Addr: c.RemoteAddr(), Interface: iface})
+
 		go func() {
 			defer func() {
 				// The C implementation immediately closes the connection once
 				// a request is processed.
 				_ = c.Close()
+				s.observe(Event{Type: EventClosed, Addr: c.RemoteAddr(), Interface: iface})
+
+				s.mu.Lock()
+				delete(s.conns, c)
+				s.mu.Unlock()
+
+				s.release()
 				s.wg.Done()
 			}()
 
-			s.handle(c)
+			s.handle(c, iface)
 		}()
 	}
 }
 
-// Close closes the server listener and waits for all requests to complete.
+// Close immediately closes all server listeners and active connections,
+// cancels active requests, and waits for their handlers to return. Close may
+// be called at any time, including before Serve, and during Shutdown to
+// forcibly close any remaining connections. Only the first call to Close or
+// Shutdown reports errors from closing the listeners.
 func (s *Server) Close() error {
+	// Force any remaining connections closed even if the listeners were
+	// already closed by Shutdown or a previous call to Close.
+	_, err := s.stop()
+
+	s.cancelRequests()
+	s.closeConns()
+	s.wg.Wait()
+	return err
+}
+
+// Shutdown gracefully shuts down the server. Shutdown first closes all server
+// listeners and then waits for all active requests to complete. If ctx expires
+// before the requests complete, all remaining connections are forcibly closed
+// and the error from ctx is returned.
+//
+// Shutdown may be called at any time, including before Serve, and subsequent
+// calls to Shutdown are no-ops. Call Close to forcibly close all connections
+// without waiting for ctx to expire.
+func (s *Server) Shutdown(ctx context.Context) error {
+	ok, err := s.stop()
+	if !ok {
+		return nil
+	}
+
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		s.wg.Wait()
+	}()
+
+	select {
+	case <-doneC:
+		return err
+	case <-ctx.Done():
+		s.cancelRequests()
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+// stop marks the server closed and closes its listeners. It returns false if
+// the server's listeners were already closed.
+func (s *Server) stop() (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	defer s.wg.Wait()
-	return s.l.Close()
+	if s.closed {
+		return false, nil
+	}
+	s.closed = true
+
+	if s.doneC != nil {
+		close(s.doneC)
+	}
+
+	var err error
+	for l := range s.listeners {
+		if lerr := l.Close(); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+
+	return true, err
 }
 
-// handle handles an individual request. handle should be called in a goroutine.
-func (s *Server) handle(c net.Conn) {
-	p, cmd, err := parseRequest(c)
-	if err != nil {
+// listenerInterface returns the name of the network interface l is bound to,
+// if any.
+func listenerInterface(l net.Listener) string {
+	if a, ok := l.Addr().(*net.TCPAddr); ok {
+		return a.Zone
+	}
+
+	return ""
+}
+
+// acquire waits for a connection slot when s.MaxConnections is set. It returns
+// false if the server is closed while waiting.
+func (s *Server) acquire() bool {
+	if s.sem == nil {
+		return true
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	s.logf("reached maximum of %d concurrent connections, delaying accept", s.MaxConnections)
+
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	case <-s.doneC:
+		return false
+	}
+}
+
+// release frees a connection slot acquired by acquire.
+func (s *Server) release() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+// cancelRequests cancels the contexts of all active requests.
+func (s *Server) cancelRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// closeConns forcibly closes all active connections.
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+// isClosed reports whether Close or Shutdown has been called.
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// handler produces the Handler which serves all requests, falling back to any
+// function fields for commands a ServeMux does not handle and applying
+// s.Middleware. It also returns a function which reports whether a command is
+// registered with the Handler, which is only possible for a ServeMux.
+func (s *Server) handler() (Handler, func(command string) bool) {
+	h := s.Handler
+	if h == nil {
+		h = NewServeMux()
+	}
+
+	var rh Handler
+	switch {
+	case s.RequestIPContext != nil:
+		rh = RequestIPContextHandler(s.RequestIPContext)
+	case s.RequestIP != nil:
+		rh = RequestIPHandler(s.RequestIP)
+	}
+
+	known := func(string) bool { return false }
+	if mux, ok := h.(*ServeMux); ok {
+		known = func(command string) bool {
+			return mux.knows(command) || (command == "request_ip" && rh != nil)
+		}
+	}
+
+	if mux, ok := h.(*ServeMux); ok && rh != nil {
+		// Don't modify the caller's ServeMux, which may be shared with other
+		// Servers. Instead, consult a private ServeMux for any request_ip
+		// commands the caller's ServeMux does not handle.
+		fallback := NewServeMux()
+		fallback.HandleVersion("request_ip", defaultVersion, rh)
+
+		h = HandlerFunc(func(w io.Writer, r *Request) error {
+			if r.Command == "request_ip" && !mux.handles(r.Command, version(r)) {
+				return fallback.ServeWGDynamic(w, r)
+			}
+
+			return mux.ServeWGDynamic(w, r)
+		})
+	}
+
+	return chain(h, s.Middleware), known
+}
+
+// handle handles an individual request received on interface iface. handle
+// should be called in a goroutine.
+func (s *Server) handle(c net.Conn, iface string) {
+	if s.ReadTimeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+
+	// Buffer the response so that a handler which fails or times out cannot
+	// send a partial response to the client.
+	var b bytes.Buffer
+
+	req, err := parseRequest(c, limits{
+		MaxLineLength: s.MaxLineLength,
+		MaxPairs:      s.MaxPairs,
+		MaxIPs:        s.MaxIPs,
+	}.withDefaults())
+
+	var (
+		// The protocol error sent to the client, if any, and its cause.
+		werr  *Error
+		cause error
+
+		// Whether the request was dispatched to a registered Handler.
+		dispatch bool
+
+		start = time.Now()
+	)
+
+	switch {
+	case err == nil:
+		req.Addr = c.RemoteAddr()
+		req.Interface = iface
+		req.strict = s.Strict
+
+		s.observe(Event{
+			Type:      EventParsed,
+			Addr:      req.Addr,
+			Interface: iface,
+			Command:   req.Command,
+			RequestIP: s.observeRequestIP(req.Command, req.Pairs, nil),
+		})
+
+		// Reject rate limited requests before doing any further work on
+		// their behalf.
+		if s.rl != nil && !s.rl.allow(clientKey(req.Addr)) {
+			s.logf("%s: %q rejected: exceeded rate limit of %g requests per second",
+				c.RemoteAddr().String(), req.Command, s.PeerRate)
+			werr, cause = ErrInvalidRequest, errRateLimited
+			break
+		}
+
+		ctx, cancel := s.requestContext(c, req, start)
+		defer cancel()
+		req.ctx = ctx
+
+		// Pass the request to the appropriate handler.
+		err := s.serve(&b, req)
+		dispatch = dispatched(ctx)
+
+		e := Event{
+			Type:      EventHandled,
+			Addr:      req.Addr,
+			Interface: iface,
+			Command:   req.Command,
+			Err:       err,
+		}
+		if err == nil {
+			e.RequestIP = s.observeRequestIP(req.Command, nil, b.Bytes())
+		}
+		s.observe(e)
+
+		if err != nil {
+			// If the function returned *Error, use that. Otherwise, log the
+			// error and specify a generic error.
+			var ok bool
+			werr, ok = err.(*Error)
+			if !ok {
+				s.logf("%s: %q error: %v", c.RemoteAddr().String(), req.Command, err)
+				werr = ErrInvalidRequest
+			}
+			cause = err
+		}
+	case isTimeout(err):
+		s.logf("%s: timed out reading request after %s", c.RemoteAddr().String(), s.ReadTimeout)
+		return
+	case errors.Is(err, errTooLarge), errors.Is(err, errBadVersion):
+		// The client sent an oversized or malformed request, so inform it of
+		// the error.
+		s.logf("%s: error parsing request: %v", c.RemoteAddr().String(), err)
+		req = &Request{Addr: c.RemoteAddr(), Interface: iface}
+		werr, cause = ErrInvalidRequest, err
+	default:
 		s.logf("%s: error parsing request: %v", c.RemoteAddr().String(), err)
 		return
 	}
 
-	// Pass the request to the appropriate handler.
-	switch cmd {
-	case "request_ip":
-		err = s.handleRequestIP(c, p)
-	default:
-		// No such command.
-		err = ErrInvalidRequest
+	s.Metrics.observeServer(s.metricsCommand(req.Command, dispatch), werr, time.Since(start))
+
+	if werr != nil {
+		b.Reset()
+		s.writeError(&b, werr)
+	}
+
+	if s.WriteTimeout > 0 {
+		_ = c.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
 	}
-	if err == nil {
-		// No error handling needed.
+
+	if _, err := b.WriteTo(c); err != nil {
+		if isTimeout(err) {
+			s.logf("%s: timed out writing %q response after %s", c.RemoteAddr().String(), req.Command, s.WriteTimeout)
+			return
+		}
+
+		s.logf("%s: error writing %q response: %v", c.RemoteAddr().String(), req.Command, err)
 		return
 	}
 
-	// If the function returned *Error, use that. Otherwise, log the error and
-	// specify a generic error.
-	werr, ok := err.(*Error)
-	if !ok {
-		s.logf("%s: %q error: %v", c.RemoteAddr().String(), cmd, err)
-		werr = ErrInvalidRequest
+	if werr != nil {
+		s.observe(Event{
+			Type:      EventErrorSent,
+			Addr:      req.Addr,
+			Interface: iface,
+			Command:   req.Command,
+			Error:     werr,
+			Err:       cause,
+		})
+	}
+}
+
+// metricsCommand returns the command used to record metrics for a request
+// for cmd. Requests which were not dispatched to a Handler registered with a
+// ServeMux, and whose command is not registered with the Server's ServeMux,
+// are recorded as "unknown", so that clients cannot create an unbounded number
+// of metrics regardless of the errors returned.
+func (s *Server) metricsCommand(cmd string, dispatch bool) string {
+	if dispatch || s.known(cmd) {
+		return cmd
 	}
 
-	// TODO(mdlayher): add serialization logic for Error type.
-	_, _ = io.WriteString(c, fmt.Sprintf("errno=%d\nerrmsg=%s\n\n",
-		werr.Number, werr.Message))
+	return "unknown"
 }
 
-// handleRequestIP processes a request_ip command.
-func (s *Server) handleRequestIP(c net.Conn, p *kvParser) error {
-	if s.RequestIP == nil {
-		// Not implemented by caller.
-		return ErrInvalidRequest
+// writeError writes the protocol error err to w. If err cannot be marshaled,
+// ErrInvalidRequest is written instead.
+func (s *Server) writeError(w io.Writer, err *Error) {
+	b, merr := err.MarshalBinary()
+	if merr != nil {
+		s.logf("failed to marshal protocol error: %v", merr)
+		b, _ = ErrInvalidRequest.MarshalBinary()
 	}
 
-	req, err := parseRequestIP(p)
-	if err != nil {
-		return err
+	_, _ = w.Write(append(b, '\n'))
+}
+
+// requestContext produces the context for r, which was received on c at time
+// received. The context is canceled when c is closed by the client or when
+// the Server is closed.
+func (s *Server) requestContext(c net.Conn, r *Request, received time.Time) (context.Context, context.CancelFunc) {
+	ri := &RequestInfo{
+		Addr:      r.Addr,
+		Interface: r.Interface,
+		Received:  received,
 	}
 
-	res, err := s.RequestIP(c.RemoteAddr(), req)
-	if err != nil {
+	if s.PeerResolver != nil {
+		p, err := s.PeerResolver.Resolve(r.Addr)
+		if err != nil {
+			s.logf("%s: failed to resolve peer: %v", r.Addr.String(), err)
+		} else {
+			ri.Peer = p
+		}
+	}
+
+	ctx, cancel := context.WithCancel(withDispatch(withRequestInfo(s.ctx, ri)))
+
+	// The client sends a single request per connection, so discard any
+	// further input until the connection is closed. Clear any read deadline
+	// so reading only completes when the client closes or resets the
+	// connection, or the Server closes the connection after responding.
+	//
+	// A client may shut down its side of the connection after sending its
+	// request and still await the response, which is indistinguishable from
+	// a normal close, so only a connection error, such as a reset, cancels
+	// the request; io.EOF does not.
+	_ = c.SetReadDeadline(time.Time{})
+	go func() {
+		if _, err := io.Copy(io.Discard, c); err != nil {
+			cancel()
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// serve invokes s.h to serve r, enforcing s.HandlerTimeout if set.
+func (s *Server) serve(w io.Writer, r *Request) error {
+	if s.HandlerTimeout <= 0 {
+		return s.h.ServeWGDynamic(w, r)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.HandlerTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	// The handler may continue running after the timeout expires, so give it
+	// a separate buffer which is only copied to w on success.
+	var (
+		b    bytes.Buffer
+		errC = make(chan error, 1)
+	)
+	// Track the handler so that Close waits for it even if it outlives the
+	// timeout.
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		errC <- s.h.ServeWGDynamic(&b, r)
+	}()
+
+	select {
+	case err := <-errC:
+		if err != nil {
+			return err
+		}
+
+		_, err = b.WriteTo(w)
 		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("wgdynamic: handler timed out after %s", s.HandlerTimeout)
+		}
+
+		return ctx.Err()
 	}
+}
 
-	return sendRequestIP(c, fromServer, res)
+// isTimeout reports whether err is a network timeout error.
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
 }
 
 // logf creates a formatted log entry if s.Log is not nil.
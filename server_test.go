@@ -1,15 +1,21 @@
 package wgdynamic_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/mdlayher/wgdynamic-go"
 )
 
@@ -71,6 +77,22 @@ func requestIPTests(t *testing.T) []subtest {
 				}
 			},
 		},
+		{
+			name: "unsupported version",
+			s: &wgdynamic.Server{
+				RequestIP: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+					panic("should not be called")
+				},
+			},
+			fn: func(t *testing.T, c *wgdynamic.Client) {
+				c.Version = 2
+
+				_, err := c.RequestIP(context.Background(), nil)
+				if diff := cmp.Diff(wgdynamic.ErrUnsupportedProtocol, err); diff != "" {
+					t.Fatalf("unexpected error (-want +got):\n%s", diff)
+				}
+			},
+		},
 		{
 			name: "generic error",
 			s: &wgdynamic.Server{
@@ -109,6 +131,74 @@ func requestIPTests(t *testing.T) []subtest {
 				}
 			},
 		},
+		{
+			name: "OK extensions",
+			s: &wgdynamic.Server{
+				RequestIP: func(_ net.Addr, r *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+					// Echo the client's extensions and attach another.
+					return &wgdynamic.RequestIP{
+						IPs:        ips,
+						LeaseStart: want.LeaseStart,
+						LeaseTime:  want.LeaseTime,
+						Extensions: append(r.Extensions, wgdynamic.Pair{Key: "mtu", Value: "1420"}),
+					}, nil
+				},
+			},
+			fn: func(t *testing.T, c *wgdynamic.Client) {
+				// Invalid extensions are rejected rather than sent to the server.
+				_, err := c.RequestIP(context.Background(), &wgdynamic.RequestIP{
+					Extensions: []wgdynamic.Pair{{Key: "ip", Value: "192.0.2.1/32"}},
+				})
+				if err == nil {
+					t.Fatal("expected an error, but none occurred")
+				}
+
+				got, err := c.RequestIP(context.Background(), &wgdynamic.RequestIP{
+					Extensions: []wgdynamic.Pair{
+						{Key: "x-site", Value: "nyc"},
+						{Key: "x-flags", Value: ""},
+					},
+				})
+				if err != nil {
+					t.Fatalf("failed to request IP: %v", err)
+				}
+
+				want := &wgdynamic.RequestIP{
+					IPs:        ips,
+					LeaseStart: want.LeaseStart,
+					LeaseTime:  want.LeaseTime,
+					Extensions: []wgdynamic.Pair{
+						{Key: "x-site", Value: "nyc"},
+						{Key: "x-flags", Value: ""},
+						{Key: "mtu", Value: "1420"},
+					},
+				}
+
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Fatalf("unexpected RequestIP (-want +got):\n%s", diff)
+				}
+			},
+		},
+		{
+			name: "OK ServeMux",
+			s: &wgdynamic.Server{
+				// The RequestIP field is registered with the ServeMux.
+				Handler: wgdynamic.NewServeMux(),
+				RequestIP: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+					return want, nil
+				},
+			},
+			fn: func(t *testing.T, c *wgdynamic.Client) {
+				got, err := c.RequestIP(context.Background(), nil)
+				if err != nil {
+					t.Fatalf("failed to request IP: %v", err)
+				}
+
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Fatalf("unexpected RequestIP (-want +got):\n%s", diff)
+				}
+			},
+		},
 		{
 			name: "OK auto assign",
 			s: &wgdynamic.Server{
@@ -135,6 +225,229 @@ func requestIPTests(t *testing.T) []subtest {
 	}
 }
 
+func TestServerLimits(t *testing.T) {
+	var lb bytes.Buffer
+	c, done := testServer(t, &wgdynamic.Server{
+		RequestIP: func(_ net.Addr, r *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			return r, nil
+		},
+		MaxIPs: 1,
+		Log:    log.New(&lb, "", 0),
+	})
+
+	_, err := c.RequestIP(context.Background(), &wgdynamic.RequestIP{
+		IPs: []*net.IPNet{
+			mustIPNet("192.0.2.1/32"),
+			mustIPNet("2001:db8::1/128"),
+		},
+	})
+	if diff := cmp.Diff(wgdynamic.ErrInvalidRequest, err); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+
+	done()
+
+	if !strings.Contains(lb.String(), "more than 1 IP addresses") {
+		t.Fatalf("unexpected log output: %q", lb.String())
+	}
+}
+
+func TestServerStrict(t *testing.T) {
+	var lb bytes.Buffer
+	s := &wgdynamic.Server{
+		RequestIP: func(_ net.Addr, r *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			return r, nil
+		},
+		Strict: true,
+		Log:    log.New(&lb, "", 0),
+	}
+
+	c, done := testServer(t, s)
+
+	// The Client refuses to send a lease start, so dial the server directly
+	// to send a request which is only invalid in strict mode.
+	conn, err := c.Dial(context.Background())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "request_ip=1\nleasestart=1\n\n"); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	done()
+
+	if diff := cmp.Diff("errno=1\nerrmsg=Invalid request\n\n", string(b)); diff != "" {
+		t.Fatalf("unexpected response (-want +got):\n%s", diff)
+	}
+
+	if !strings.Contains(lb.String(), `line "leasestart=1": key is only valid in server responses`) {
+		t.Fatalf("unexpected log output: %q", lb.String())
+	}
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		active, peak int
+	)
+
+	c, done := testServer(t, &wgdynamic.Server{
+		RequestIP: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			mu.Lock()
+			active++
+			if active > peak {
+				peak = active
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+
+			return &wgdynamic.RequestIP{LeaseTime: 10 * time.Second}, nil
+		},
+		MaxConnections: 1,
+	})
+	defer done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := c.RequestIP(context.Background(), nil); err != nil {
+				panicf("failed to request IP: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak != 1 {
+		t.Fatalf("expected at most 1 concurrent request, but got: %d", peak)
+	}
+}
+
+func TestServerPeerRate(t *testing.T) {
+	var lb bytes.Buffer
+	c, done := testServer(t, &wgdynamic.Server{
+		RequestIP: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			return &wgdynamic.RequestIP{LeaseTime: 10 * time.Second}, nil
+		},
+		// Effectively allow only a single burst of requests.
+		PeerRate:  0.001,
+		PeerBurst: 2,
+		Log:       log.New(&lb, "", 0),
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.RequestIP(context.Background(), nil); err != nil {
+			t.Fatalf("failed to request IP: %v", err)
+		}
+	}
+
+	_, err := c.RequestIP(context.Background(), nil)
+	if diff := cmp.Diff(wgdynamic.ErrInvalidRequest, err); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+
+	done()
+
+	if !strings.Contains(lb.String(), "exceeded rate limit") {
+		t.Fatalf("unexpected log output: %q", lb.String())
+	}
+}
+
+func TestServerMultipleListeners(t *testing.T) {
+	ips := map[string]string{
+		"wg0": "192.0.2.1/32",
+		"wg1": "192.0.2.2/32",
+	}
+
+	mux := wgdynamic.NewServeMux()
+	mux.HandleFunc("request_ip", func(w io.Writer, r *wgdynamic.Request) error {
+		ip, ok := ips[r.Interface]
+		if !ok {
+			return wgdynamic.ErrIPUnavailable
+		}
+
+		_, err := io.WriteString(w, "ip="+ip+"\nleasetime=10\n\n")
+		return err
+	})
+
+	s := &wgdynamic.Server{Handler: mux}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, iface := range []string{"wg0", "wg1"} {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+
+		// Simulate a listener bound to a WireGuard interface by Listen.
+		zl := &zoneListener{Listener: l, zone: iface}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := s.Serve(zl); err != wgdynamic.ErrServerClosed {
+				panicf("failed to serve: %v", err)
+			}
+		}()
+
+		c := &wgdynamic.Client{
+			Dial: func(ctx context.Context) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", l.Addr().String())
+			},
+		}
+
+		got, err := c.RequestIP(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("failed to request IP on %q: %v", iface, err)
+		}
+
+		want := &wgdynamic.RequestIP{
+			IPs:       []*net.IPNet{mustIPNet(ips[iface])},
+			LeaseTime: 10 * time.Second,
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("unexpected RequestIP on %q (-want +got):\n%s", iface, diff)
+		}
+	}
+
+	// Close tears down all of the listeners.
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close server: %v", err)
+	}
+}
+
+// A zoneListener is a net.Listener which reports a TCP address with an IPv6
+// zone.
+type zoneListener struct {
+	net.Listener
+	zone string
+}
+
+func (l *zoneListener) Addr() net.Addr {
+	a := *l.Listener.Addr().(*net.TCPAddr)
+	a.Zone = l.zone
+	return &a
+}
+
 func testServer(t *testing.T, s *wgdynamic.Server) (*wgdynamic.Client, func()) {
 	t.Helper()
 
@@ -149,11 +462,7 @@ func testServer(t *testing.T, s *wgdynamic.Server) (*wgdynamic.Client, func()) {
 	go func() {
 		defer wg.Done()
 
-		if err := s.Serve(l); err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				return
-			}
-
+		if err := s.Serve(l); err != wgdynamic.ErrServerClosed {
 			panicf("failed to serve: %v", err)
 		}
 	}()
@@ -173,3 +482,272 @@ func testServer(t *testing.T, s *wgdynamic.Server) (*wgdynamic.Client, func()) {
 		}
 	}
 }
+
+func TestServerCloseBeforeServe(t *testing.T) {
+	s := &wgdynamic.Server{}
+
+	// Close and Shutdown are safe to call before Serve and are idempotent.
+	for i := 0; i < 2; i++ {
+		if err := s.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatalf("failed to shut down: %v", err)
+		}
+	}
+
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	if err := s.Serve(l); err != wgdynamic.ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, but got: %v", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		sleep time.Duration
+		err   error
+	}{
+		{
+			name:  "graceful",
+			sleep: 50 * time.Millisecond,
+		},
+		{
+			name:  "deadline exceeded",
+			sleep: 1 * time.Second,
+			err:   context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startC := make(chan struct{})
+			s := &wgdynamic.Server{
+				RequestIP: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+					close(startC)
+					time.Sleep(tt.sleep)
+					return &wgdynamic.RequestIP{LeaseTime: 10 * time.Second}, nil
+				},
+			}
+
+			c, done := testServer(t, s)
+			defer done()
+
+			errC := make(chan error, 1)
+			go func() {
+				_, err := c.RequestIP(context.Background(), nil)
+				errC <- err
+			}()
+
+			// Wait for the request to be in flight before shutting down.
+			<-startC
+
+			ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+			defer cancel()
+
+			if diff := cmp.Diff(tt.err, s.Shutdown(ctx), cmpopts.EquateErrors()); diff != "" {
+				t.Fatalf("unexpected Shutdown error (-want +got):\n%s", diff)
+			}
+
+			// A graceful shutdown allows the request to complete.
+			if err := <-errC; tt.err == nil && err != nil {
+				t.Fatalf("failed to request IP: %v", err)
+			}
+		})
+	}
+}
+
+func TestServerCloseDuringShutdown(t *testing.T) {
+	var (
+		startC = make(chan struct{})
+		doneC  = make(chan error, 1)
+	)
+
+	s := &wgdynamic.Server{
+		RequestIPContext: func(ctx context.Context, _ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			close(startC)
+
+			select {
+			case <-ctx.Done():
+				doneC <- ctx.Err()
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+				doneC <- nil
+				return nil, wgdynamic.ErrIPUnavailable
+			}
+		},
+	}
+
+	c, done := testServer(t, s)
+	defer done()
+
+	errC := make(chan error, 1)
+	go func() {
+		_, err := c.RequestIP(context.Background(), nil)
+		errC <- err
+	}()
+
+	// Begin a graceful shutdown which never expires while a request is in
+	// flight.
+	<-startC
+
+	shutdownC := make(chan error, 1)
+	go func() { shutdownC <- s.Shutdown(context.Background()) }()
+
+	// Wait for Shutdown to close the listener.
+	for {
+		conn, err := c.Dial(context.Background())
+		if err != nil {
+			break
+		}
+		_ = conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Close must still forcibly close the connection and wait for the
+	// handler, which observes the canceled request.
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	select {
+	case err := <-doneC:
+		if err == nil {
+			t.Fatal("handler context was not canceled")
+		}
+	default:
+		t.Fatal("Close returned before the handler")
+	}
+
+	if err := <-errC; err == nil {
+		t.Fatal("expected a client error, but none occurred")
+	}
+	if err := <-shutdownC; err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	t.Run("read", func(t *testing.T) {
+		var lb bytes.Buffer
+		s := &wgdynamic.Server{
+			ReadTimeout: 50 * time.Millisecond,
+			Log:         log.New(&lb, "", 0),
+		}
+
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = s.Serve(l)
+		}()
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer c.Close()
+
+		// Send an incomplete request and wait for the server to give up.
+		if _, err := io.WriteString(c, "request_ip=1\n"); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+
+		if _, err := ioutil.ReadAll(c); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatalf("failed to close server: %v", err)
+		}
+		wg.Wait()
+
+		if !strings.Contains(lb.String(), "timed out reading request after 50ms") {
+			t.Fatalf("unexpected log output: %q", lb.String())
+		}
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		var (
+			lb       bytes.Buffer
+			returned int32
+		)
+
+		c, done := testServer(t, &wgdynamic.Server{
+			RequestIP: func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+				time.Sleep(500 * time.Millisecond)
+				atomic.StoreInt32(&returned, 1)
+				return &wgdynamic.RequestIP{LeaseTime: 10 * time.Second}, nil
+			},
+			HandlerTimeout: 50 * time.Millisecond,
+			Log:            log.New(&lb, "", 0),
+		})
+
+		_, err := c.RequestIP(context.Background(), nil)
+		if diff := cmp.Diff(wgdynamic.ErrInvalidRequest, err); diff != "" {
+			t.Fatalf("unexpected error (-want +got):\n%s", diff)
+		}
+
+		// Closing the server must wait for the abandoned handler.
+		done()
+		if atomic.LoadInt32(&returned) != 1 {
+			t.Fatal("server closed before timed out handler returned")
+		}
+
+		if !strings.Contains(lb.String(), "handler timed out after 50ms") {
+			t.Fatalf("unexpected log output: %q", lb.String())
+		}
+	})
+}
+
+func TestServerSharedServeMux(t *testing.T) {
+	mux := wgdynamic.NewServeMux()
+	mux.HandleFunc("echo", func(w io.Writer, _ *wgdynamic.Request) error {
+		_, err := io.WriteString(w, "\n")
+		return err
+	})
+
+	requestIP := func(s string) func(net.Addr, *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+		return func(_ net.Addr, _ *wgdynamic.RequestIP) (*wgdynamic.RequestIP, error) {
+			return &wgdynamic.RequestIP{IPs: []*net.IPNet{mustIPNet(s)}}, nil
+		}
+	}
+
+	// Each Server must use its own RequestIP function despite sharing mux.
+	for _, s := range []string{"192.0.2.1/32", "192.0.2.2/32"} {
+		c, done := testServer(t, &wgdynamic.Server{
+			Handler:   mux,
+			RequestIP: requestIP(s),
+		})
+
+		res, err := c.RequestIP(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("failed to request IP: %v", err)
+		}
+
+		if diff := cmp.Diff([]*net.IPNet{mustIPNet(s)}, res.IPs); diff != "" {
+			t.Fatalf("unexpected IPs (-want +got):\n%s", diff)
+		}
+
+		if _, err := c.Do(context.Background(), &wgdynamic.Message{Command: "echo"}); err != nil {
+			t.Fatalf("failed to echo: %v", err)
+		}
+
+		done()
+	}
+
+	// The shared ServeMux itself must not have been modified.
+	err := mux.ServeWGDynamic(io.Discard, &wgdynamic.Request{Command: "request_ip"})
+	if diff := cmp.Diff(wgdynamic.ErrInvalidRequest, err); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+}